@@ -0,0 +1,122 @@
+//Autotags
+// A general classifier's idea of what's in each thumbnail, dog, car, beach and so on
+// Kept per thumbnail in thumbtag, then rolled up per file into autotag, one row a label
+// Searches see them as "autotag" tags (see the searchtags view), plain searches still find them
+
+package av
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+// Labels the thumbnails of filename which haven't been labelled by this tagger yet
+// Nothing to do without a tagger
+func (e *Evaluator) autotag(db *sql.DB, filename string) error {
+	if e.tmb.TagVersion() == "" {
+		return nil
+	}
+
+	thumbnames, err := util.AllRows1[string](db, `
+		select thumbname
+		from thumbnail
+		where tagversion is not :tagversion
+		and thumbname in (
+			select thumbname
+			from thumbmap
+			where filename = :filename);
+		`,
+		sql.Named("filename", filename),
+		sql.Named("tagversion", e.tmb.TagVersion()))
+	if err != nil {
+		return err
+	}
+
+	for _, thumbname := range thumbnames {
+		err = e.tagThumbnail(db, thumbname)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Thumbnails that can't be read are marked done with no labels, same as assess
+func (e *Evaluator) tagThumbnail(db *sql.DB, thumbname string) error {
+	var labels []avc.Label
+	b, err := e.store.Get(thumbname)
+	if err == nil {
+		labels, err = e.tmb.ClassifyImageBuf(b)
+	}
+	if err != nil {
+		log.Printf("%s: %s", thumbname, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`delete from thumbtag where thumbname = :thumbname;`,
+		sql.Named("thumbname", thumbname))
+	if err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		_, err = tx.Exec(`
+			insert or replace into
+				thumbtag (thumbname, label, confidence)
+				values (:thumbname, :label, :confidence);`,
+			sql.Named("thumbname", thumbname),
+			sql.Named("label", label.Name),
+			sql.Named("confidence", label.Confidence))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`update thumbnail set tagversion = :tagversion where thumbname = :thumbname;`,
+		sql.Named("thumbname", thumbname),
+		sql.Named("tagversion", e.tmb.TagVersion()))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// A file's autotags are the labels of its current thumbnails, each as sure as its surest thumbnail
+func refreshAutoTags(db *sql.DB, filename string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`delete from autotag where filename = :filename;`,
+
+		`insert into autotag (filename, label, confidence)
+		select :filename, b.label, max(b.confidence)
+		from thumbmap a
+		inner join thumbtag b
+		on a.thumbname = b.thumbname
+		where a.filename = :filename
+		group by b.label;`,
+	}
+
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt, sql.Named("filename", filename))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -2,6 +2,7 @@ package av
 
 import (
 	"bytes"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -12,16 +13,22 @@ import (
 	"golang.org/x/crypto/blake2b"
 
 	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/media"
 )
 
 var errNotMediaFile = errors.New("File is not an image or video")
-var errSeekFailed = errors.New("Seek failed")
+
+// Where metadata and first thumbnails come from, main sets it from -mediabackend
+var Backend media.Backend = media.DefaultBackend
 
 // digest is the hex2str hash of the image
+// pos is where in the source the frame came from (0.0 to 1.0)
+// not valid when the thumbnail isn't a frame at all, e.g. waveforms
 type Thumbnail struct {
 	digest string
 	source string
 	image  []byte
+	pos    sql.NullFloat64
 }
 
 type MediaInfo struct {
@@ -43,9 +50,9 @@ func ParseMediaFile(filename string) (m MediaInfo, err error) {
 		return
 	}
 
-	m.metadata, err = avc.GetMetadata(filename)
+	m.metadata, err = Backend.GetMetadata(filename)
 	if err != nil {
-		if fmt.Sprintf("%s", err) == "Invalid data found when processing input" {
+		if errors.Is(err, media.ErrNotMediaFile) {
 			// Just isn't a media file
 			err = errNotMediaFile
 			return
@@ -106,40 +113,42 @@ func CreateThumbnails(pathIn string, num int) ([]Thumbnail, bool, error) {
 // Wrapper to handle various media situations
 // Consider unseekable files, files with no video (audio files we'll call them), etc.
 func CreateThumbnail(pathIn string, pos float64) (t Thumbnail, seek bool, err error) {
-	tmpFile, err := os.CreateTemp(os.TempDir(), "http-server-av.*.webp")
-	if err != nil {
-		log.Printf("%s", err)
-		return
-	}
-	defer os.Remove(tmpFile.Name())
+	var b []byte
+	framePos := sql.NullFloat64{Float64: pos, Valid: true}
 
 	seek = true
-	err = avc.CreateThumbnailX(pathIn, tmpFile.Name(), seek, pos)
+	b, err = Backend.CreateThumbnailX(pathIn, seek, pos)
 	// Some streams don't support seeking
 	// In this case just do a thumbnail of the first frame
 	// Better than nothing
-	if errors.Is(err, errSeekFailed) || fmt.Sprintf("%s", err) == "End of file" {
+	if errors.Is(err, media.ErrSeekFailed) {
 		seek = false
-		err = avc.CreateThumbnailX(pathIn, tmpFile.Name(), seek, pos)
+		framePos.Float64 = 0
+		b, err = Backend.CreateThumbnailX(pathIn, seek, pos)
 		if err != nil {
 			log.Printf("%s: %s", pathIn, err)
 		}
 	}
 
-	// When all else fails, go generic
+	// No picture to take, e.g. audio without cover art
+	// Draw the waveform instead
 	if err != nil {
 		seek = false
-		err = avc.CreateGenericThumbnail(tmpFile.Name())
+		framePos.Valid = false
+		b, err = avc.CreateWaveformThumbnail(pathIn)
 		if err != nil {
 			log.Printf("%s: %s", pathIn, err)
-			return
 		}
 	}
 
-	b, err := io.ReadAll(tmpFile)
+	// When all else fails, go generic
 	if err != nil {
-		log.Printf("%s", err)
-		return
+		seek = false
+		b, err = Backend.CreateGenericThumbnail()
+		if err != nil {
+			log.Printf("%s: %s", pathIn, err)
+			return
+		}
 	}
 
 	digest, err := Checksum(b)
@@ -152,6 +161,7 @@ func CreateThumbnail(pathIn string, pos float64) (t Thumbnail, seek bool, err er
 		source: pathIn,
 		digest: digest,
 		image:  b,
+		pos:    framePos,
 	}, seek, err
 }
 
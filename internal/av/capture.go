@@ -0,0 +1,83 @@
+//Captures
+// A thumbnail from exactly where the user paused, pinned as the file's thumbnail
+// Evaluated like any other thumbnail, but the pin keeps it in place whatever it scores
+
+package av
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
+)
+
+// Returns the new thumbnail's name
+func CaptureThumbnail(db *sql.DB, store thumbstore.ThumbStore, filename string, seconds float64) (string, error) {
+	// filename comes from a request, only files we know about get opened
+	var known int
+	err := db.QueryRow(`select count(*) from mediastat where filename = :filename;`,
+		sql.Named("filename", filename)).Scan(&known)
+	if err != nil {
+		return "", err
+	}
+	if known == 0 {
+		return "", fmt.Errorf("%s: not a known media file", filename)
+	}
+
+	b, pos, err := avc.CreateThumbnailAt(filename, seconds)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := Checksum(b)
+	if err != nil {
+		return "", err
+	}
+
+	thumbnail := Thumbnail{
+		source: filename,
+		digest: digest,
+		image:  b,
+		pos:    sql.NullFloat64{Float64: pos, Valid: true},
+	}
+	thumbname := fmt.Sprintf("%s.webp", digest)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	err = insertThumbnail(tx, store, filename, thumbnail)
+	if err != nil {
+		return "", err
+	}
+
+	// facechecked = 0 gets the evaluator to score it
+	_, err = tx.Exec(`
+		update mediastat set
+			bestthumb = :thumbname,
+			pinned = 1,
+			facechecked = 0
+		where filename = :filename;`,
+		sql.Named("filename", filename),
+		sql.Named("thumbname", thumbname))
+	if err != nil {
+		return "", err
+	}
+
+	return thumbname, tx.Commit()
+}
+
+// Lets the best scoring thumbnail take over again
+// The pin comes off whatever happens next, even for a file with no thumbnails left to pick from
+func Unpin(db *sql.DB, filename string) error {
+	_, err := db.Exec(`update mediastat set pinned = 0 where filename = :filename;`,
+		sql.Named("filename", filename))
+	if err != nil {
+		return err
+	}
+
+	return Rescore(db, filename)
+}
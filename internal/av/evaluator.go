@@ -1,26 +1,40 @@
 //Evaluator
 // Goes through thumbnails, finds faces, saves face discovery information to the database
+// Faces are looked for a batch of thumbnails at a time, straight from the store
+// Also rates every thumbnail on sharpness, exposure and colour, so faceless videos get a score too
+// And labels what else is in them, see autotag.go
 
 //Improver
 // Finds media files which have poor thumbnails and adds more thumbnails
 // (hoping the new ones will be better)
+// New positions come from scene analysis first, random ones after that
 
 package av
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"math"
 	"math/rand"
-	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
 	"github.com/jml-89/http-server-av/internal/util"
 )
 
-func ScoreFunc(area int, confidence float64, quality float64) float64 {
-	return math.Sqrt(math.Max(0.0, float64(area))) * confidence * quality
+// How much a perfect aesthetic score is worth next to faces
+// A decent face (30000 area, 0.85 confidence, 0.6 quality) comes to about 88
+const aestheticWeight = 100.0
+
+func ScoreFunc(area int, confidence float64, quality float64, aesthetic float64) float64 {
+	faces := math.Sqrt(math.Max(0.0, float64(area))) * confidence * quality
+	return faces + aestheticWeight*aesthetic
 }
 
 func ThumbCull(db *sql.DB, filename string) error {
@@ -54,6 +68,17 @@ func ThumbCull(db *sql.DB, filename string) error {
 					from 
 						thebest
 				)
+			and
+				thumbmap.thumbname not in (
+					select
+						bestthumb
+					from
+						mediastat
+					where
+						filename = :filename
+					and
+						pinned
+				)
 		) select thumbname from therest;`, sql.Named("filename", filename))
 	if err != nil {
 		return err
@@ -63,10 +88,16 @@ func ThumbCull(db *sql.DB, filename string) error {
 		return nil
 	}
 
+	// Only this file's mapping goes, the same thumbnail might belong to a duplicate too
+	// The thumbnail itself goes once nothing maps to it, its file is left to ThumbGC
 	stmts := []string{
-		`delete from thumbface where thumbname = :thumbname`,
-		`delete from thumbnail where thumbname = :thumbname`,
-		`delete from thumbmap where thumbname = :thumbname`,
+		`delete from thumbmap where filename = :filename and thumbname = :thumbname`,
+		`delete from thumbface where thumbname = :thumbname
+			and thumbname not in (select thumbname from thumbmap)`,
+		`delete from thumbtag where thumbname = :thumbname
+			and thumbname not in (select thumbname from thumbmap)`,
+		`delete from thumbnail where thumbname = :thumbname
+			and thumbname not in (select thumbname from thumbmap)`,
 	}
 
 	tx, err := db.Begin()
@@ -77,7 +108,9 @@ func ThumbCull(db *sql.DB, filename string) error {
 
 	for _, thumbname := range thumbnames {
 		for _, stmt := range stmts {
-			_, err = tx.Exec(stmt, sql.Named("thumbname", thumbname))
+			_, err = tx.Exec(stmt,
+				sql.Named("filename", filename),
+				sql.Named("thumbname", thumbname))
 			if err != nil {
 				return err
 			}
@@ -93,8 +126,13 @@ func ThumbCull(db *sql.DB, filename string) error {
 }
 
 func RescoreAll(db *sql.DB) error {
-	_, err := db.Exec(`update thumbnail set 
-		score = scorefn(area, confidence, quality);`)
+	expr, err := scoringExpr(db, "score")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`update thumbnail set 
+		score = coalesce((%s), 0);`, expr))
 	if err != nil {
 		return err
 	}
@@ -108,7 +146,8 @@ func RescoreAll(db *sql.DB) error {
 			inner join thumbnail y
 			on x.thumbname = y.thumbname
 		) a
-		where a.filename = mediastat.filename;`)
+		where a.filename = mediastat.filename
+		and not mediastat.pinned;`)
 	if err != nil {
 		return err
 	}
@@ -117,13 +156,18 @@ func RescoreAll(db *sql.DB) error {
 }
 
 func Rescore(db *sql.DB, filename string) error {
+	expr, err := scoringExpr(db, "score")
+	if err != nil {
+		return err
+	}
+
 	stmts := []string{
-		`update thumbnail set 
-			score = scorefn(area, confidence, quality)
+		fmt.Sprintf(`update thumbnail set 
+			score = coalesce((%s), 0)
 		where thumbname in (
 			select thumbname 
 			from thumbmap 
-			where filename = :filename);`,
+			where filename = :filename);`, expr),
 
 		`update mediastat set 
 			bestthumb = a.thumbname,
@@ -135,7 +179,8 @@ func Rescore(db *sql.DB, filename string) error {
 			on x.filename = :filename
 			and x.thumbname = y.thumbname
 		) a
-		where a.filename = mediastat.filename;`,
+		where a.filename = mediastat.filename
+		and not mediastat.pinned;`,
 	}
 
 	for _, stmt := range stmts {
@@ -149,54 +194,135 @@ func Rescore(db *sql.DB, filename string) error {
 }
 
 type Evaluator struct {
-	tmb *avc.Thumbnailer
+	tmb   avc.Thumbnailer
+	store thumbstore.ThumbStore
+	batch int
 }
 
-func NewEvaluator(threadCount int) (Evaluator, error) {
-	tmb, err := avc.NewThumbnailer(threadCount)
-	return Evaluator{tmb: tmb}, err
+// Files are evaluated this many at a time, their thumbnails pooled so face batches fill up
+const evalFiles = 16
+
+func NewEvaluator(cfg avc.ThumbnailerConfig, store thumbstore.ThumbStore) (Evaluator, error) {
+	tmb, err := avc.NewThumbnailer(cfg)
+	if err != nil {
+		return Evaluator{}, err
+	}
+
+	log.Printf("Face models version %s, tagger version %s", tmb.FaceVersion(), tmb.TagVersion())
+	if tmb.EmbedVersion() == "" {
+		log.Println("No -embedmodel, faces won't be grouped into people")
+	}
+	if tmb.TagVersion() == "" {
+		log.Println("No -tagmodel, thumbnails won't be autotagged")
+	}
+	return Evaluator{tmb: tmb, store: store, batch: max(cfg.FaceBatch, 1)}, nil
 }
 
 func (e *Evaluator) Run(db *sql.DB) (int, error) {
 	count := 0
 
-	filenames, err := util.AllRows1[string](db,
-		`select filename from mediastat where not facechecked;`,
+	// Thumbnails looked at by other models are redone, a bit at a time as this comes around
+	filenames, err := util.AllRows1[string](db, `
+		select filename
+		from mediastat
+		where not facechecked
+		or filename in (
+			select a.filename
+			from thumbmap a
+			inner join thumbnail b
+			on a.thumbname = b.thumbname
+			where b.aesthetic is null
+			or b.focus_x is null
+			or b.faceversion is not :faceversion
+			or (:tagversion != '' and b.tagversion is not :tagversion));`,
+		sql.Named("faceversion", e.tmb.FaceVersion()),
+		sql.Named("tagversion", e.tmb.TagVersion()),
 	)
 
-	for _, filename := range filenames {
-		err = e.evaluate(db, filename)
-		if err != nil {
-			return count, err
-		}
+	checked := 0
+	var elapsed time.Duration
+	for start := 0; start < len(filenames); start += evalFiles {
+		group := filenames[start:min(start+evalFiles, len(filenames))]
 
-		err = Rescore(db, filename)
+		began := time.Now()
+		n, err := e.checkFaces(db, group)
 		if err != nil {
 			return count, err
 		}
+		checked += n
+		elapsed += time.Since(began)
 
-		err = ThumbCull(db, filename)
-		if err != nil {
-			return count, err
+		for _, filename := range group {
+			err = e.evaluate(db, filename)
+			if err != nil {
+				return count, err
+			}
+
+			err = Rescore(db, filename)
+			if err != nil {
+				return count, err
+			}
+
+			err = ThumbCull(db, filename)
+			if err != nil {
+				return count, err
+			}
+
+			err = refreshAutoTags(db, filename)
+			if err != nil {
+				return count, err
+			}
+
+			count += 1
 		}
+	}
 
-		count += 1
+	if checked > 0 {
+		log.Printf("Face checked %d thumbnails in %s, %.1f a second",
+			checked, elapsed.Round(time.Millisecond), float64(checked)/elapsed.Seconds())
+	}
+
+	// No embedding model, no new people, but faces might have gone from the ones there are
+	if e.tmb.EmbedVersion() == "" {
+		return count, RefreshPeople(db)
+	}
+
+	_, err = ClusterFaces(db, e.tmb.EmbedVersion())
+	if err != nil {
+		return count, err
 	}
 
 	return count, nil
 }
 
-func Improver(db *sql.DB) (int, error) {
+func Improver(db *sql.DB, store thumbstore.ThumbStore) (int, error) {
 	count := 0
 
+	threshold, err := ScoreThreshold(db)
+	if err != nil {
+		log.Println(err)
+		return count, err
+	}
+
+	ceiling, err := AestheticCeiling(db)
+	if err != nil {
+		log.Println(err)
+		return count, err
+	}
+
+	// Files only get the extra probes once their best beats what a faceless frame can score
+	// Without a ceiling every file gets them
 	filenames, probeCounts, err := util.AllRows2[string, int](db,
 		`select filename, probes
 		from mediastat
 		where facechecked
 		and canseek
-		and ((probes < 10) or (probes < 30 and bestscore > 0))
-		and bestscore < scorefn(30000, 0.85, 0.6)
-		order by probes asc;`)
+		and not pinned
+		and ((probes < 10) or (probes < 30 and (:ceiling is null or bestscore > :ceiling)))
+		and bestscore < :threshold
+		order by probes asc;`,
+		sql.Named("threshold", threshold),
+		sql.Named("ceiling", ceiling))
 	if err != nil {
 		log.Println(err)
 		return count, err
@@ -208,7 +334,12 @@ func Improver(db *sql.DB) (int, error) {
 
 		probes += 1
 
-		thumbnail, canseek, err := CreateThumbnail(filename, rand.Float64())
+		pos, err := nextProbePos(db, filename)
+		if err != nil {
+			return count, err
+		}
+
+		thumbnail, canseek, err := CreateThumbnail(filename, pos)
 		if err != nil {
 			log.Printf("Failed to generate thumbnail for %s", filename)
 			return count, err
@@ -221,7 +352,7 @@ func Improver(db *sql.DB) (int, error) {
 		defer tx.Rollback()
 
 		//for _, thumbnail := range thumbnails {
-		err = insertThumbnail(tx, filename, thumbnail)
+		err = insertThumbnail(tx, store, filename, thumbnail)
 		if err != nil {
 			return count, err
 		}
@@ -254,73 +385,253 @@ func Improver(db *sql.DB) (int, error) {
 	return count, nil
 }
 
-func (e *Evaluator) evaluate(db *sql.DB, filename string) error {
-	thumbnames, err := util.AllRows1[string](db, `
-		select thumbname
-		from thumbnail
-		where not facechecked
-		and thumbname in (
-			select thumbname
-			from thumbmap
-			where filename = :filename);
-		`, sql.Named("filename", filename))
+// Candidates from scene analysis, kept per file so it's only done once
+const maxCandidates = 12
+
+// Where the next thumbnail for filename should be taken from
+// The best scene candidate not yet probed, or anywhere at all once they run out
+func nextProbePos(db *sql.DB, filename string) (float64, error) {
+	var analysed bool
+	err := db.QueryRow(`select candidates from mediastat where filename = :filename;`,
+		sql.Named("filename", filename)).Scan(&analysed)
+	if err != nil {
+		return 0, err
+	}
+
+	if !analysed {
+		err = storeCandidates(db, filename)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var pos float64
+	err = db.QueryRow(`
+		select pos
+		from thumbcandidate
+		where filename = :filename
+		and not probed
+		order by promise desc
+		limit 1;`,
+		sql.Named("filename", filename)).Scan(&pos)
+	if err == sql.ErrNoRows {
+		return rand.Float64(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Exec(`
+		update thumbcandidate
+		set probed = 1
+		where filename = :filename
+		and pos = :pos;`,
+		sql.Named("filename", filename),
+		sql.Named("pos", pos))
+	if err != nil {
+		return 0, err
+	}
+
+	return pos, nil
+}
+
+// Runs scene analysis for filename and saves what it finds
+// A failed analysis is logged and saved as no candidates, probing just goes back to random
+func storeCandidates(db *sql.DB, filename string) error {
+	candidates, err := avc.SceneCandidates(filename, maxCandidates)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Scene analysis failed for %s: %s", filename, err)
+		}
+		candidates = nil
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	for _, thumbname := range thumbnames {
-		thumbpath := filepath.Join(".thumbs", thumbname)
+	_, err = tx.Exec(`delete from thumbcandidate where filename = :filename;`,
+		sql.Named("filename", filename))
+	if err != nil {
+		return err
+	}
 
-		faces, err := e.tmb.RunImage(thumbpath)
+	for _, candidate := range candidates {
+		_, err = tx.Exec(`
+			insert or replace into
+				thumbcandidate (filename, pos, promise, probed)
+				values (:filename, :pos, :promise, 0);`,
+			sql.Named("filename", filename),
+			sql.Named("pos", candidate.Pos),
+			sql.Named("promise", candidate.Promise))
 		if err != nil {
-			log.Println(err)
 			return err
 		}
+	}
 
-		tx, err := db.Begin()
+	_, err = tx.Exec(`update mediastat set candidates = 1 where filename = :filename;`,
+		sql.Named("filename", filename))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Looks for faces in the thumbnails of filenames that haven't been checked by these models
+// Thumbnails go to the detector e.batch at a time, each batch's results committed together
+// Returns how many thumbnails were checked
+func (e *Evaluator) checkFaces(db *sql.DB, filenames []string) (int, error) {
+	var thumbnames []string
+	for _, filename := range filenames {
+		names, err := util.AllRows1[string](db, `
+			select thumbname
+			from thumbnail
+			where (not facechecked or faceversion is not :faceversion)
+			and thumbname in (
+				select thumbname
+				from thumbmap
+				where filename = :filename);
+			`,
+			sql.Named("filename", filename),
+			sql.Named("faceversion", e.tmb.FaceVersion()))
 		if err != nil {
-			return err
+			return 0, err
 		}
-		defer tx.Rollback()
+		thumbnames = append(thumbnames, names...)
+	}
 
-		for _, face := range faces {
-			_, err = tx.Exec(`
-				insert or replace into
-				thumbface ( thumbname, area, confidence, quality )
-				values ( :thumbname, :area, :confidence, :quality );
-			`,
-				sql.Named("thumbname", thumbname),
-				sql.Named("area", face.Area),
-				sql.Named("confidence", face.Confidence),
-				sql.Named("quality", face.Quality))
+	// Files can share thumbnails, once each is enough
+	slices.Sort(thumbnames)
+	thumbnames = slices.Compact(thumbnames)
+
+	for start := 0; start < len(thumbnames); start += e.batch {
+		err := e.checkBatch(db, thumbnames[start:min(start+e.batch, len(thumbnames))])
+		if err != nil {
+			return 0, err
 		}
+	}
 
-		stmt := `update thumbnail set
-				facechecked = 1,
-				area = sum(b.area),
-				confidence = avg(b.confidence),
-				quality = avg(b.quality)
-			from ( 
-				select area, confidence, quality
-				from thumbface
-				where thumbname = :thumbname
-			) as b
-			where thumbname = :thumbname;`
-		if len(faces) == 0 {
-			stmt = `update thumbnail set facechecked = 1 where thumbname = :thumbname;`
+	return len(thumbnames), nil
+}
+
+func (e *Evaluator) checkBatch(db *sql.DB, thumbnames []string) error {
+	// A thumbnail gone from the store has no faces, ThumbGC will tidy up its rows
+	images := make([][]byte, 0, len(thumbnames))
+	loaded := make([]int, 0, len(thumbnames))
+	for i, thumbname := range thumbnames {
+		b, err := e.store.Get(thumbname)
+		if err != nil {
+			log.Printf("%s: %s", thumbname, err)
+			continue
 		}
+		images = append(images, b)
+		loaded = append(loaded, i)
+	}
+
+	found, err := e.tmb.RunImagesBuf(images)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	faces := make([][]avc.Face, len(thumbnames))
+	for j, i := range loaded {
+		faces[i] = found[j]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		_, err = tx.Exec(stmt, sql.Named("thumbname", thumbname))
+	for i, thumbname := range thumbnames {
+		err = saveFaces(tx, thumbname, faces[i], e.tmb.FaceVersion())
 		if err != nil {
 			return err
 		}
+	}
 
-		err = tx.Commit()
+	return tx.Commit()
+}
+
+// Replaces the faces of thumbname and totals them up on its thumbnail row
+func saveFaces(tx *sql.Tx, thumbname string, faces []avc.Face, faceVersion string) error {
+	_, err := tx.Exec(`delete from thumbface where thumbname = :thumbname;`,
+		sql.Named("thumbname", thumbname))
+	if err != nil {
+		return err
+	}
+
+	for _, face := range faces {
+		landmarks, err := encodeLandmarks(face.Landmarks)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			insert into
+			thumbface ( thumbname, area, confidence, quality, box_x, box_y, box_w, box_h, landmarks, embedding )
+			values ( :thumbname, :area, :confidence, :quality, :x, :y, :w, :h, :landmarks, :embedding );
+		`,
+			sql.Named("thumbname", thumbname),
+			sql.Named("area", face.Area),
+			sql.Named("confidence", face.Confidence),
+			sql.Named("quality", face.Quality),
+			sql.Named("x", face.Box.X),
+			sql.Named("y", face.Box.Y),
+			sql.Named("w", face.Box.W),
+			sql.Named("h", face.Box.H),
+			sql.Named("landmarks", landmarks),
+			sql.Named("embedding", encodeEmbedding(face.Embedding)))
 		if err != nil {
 			return err
 		}
 	}
 
+	stmt := `update thumbnail set
+			facechecked = 1,
+			faceversion = :faceversion,
+			area = sum(b.area),
+			confidence = avg(b.confidence),
+			quality = avg(b.quality)
+		from ( 
+			select area, confidence, quality
+			from thumbface
+			where thumbname = :thumbname
+		) as b
+		where thumbname = :thumbname;`
+	if len(faces) == 0 {
+		stmt = `update thumbnail set
+				facechecked = 1,
+				faceversion = :faceversion,
+				area = 0,
+				confidence = 0,
+				quality = 0
+			where thumbname = :thumbname;`
+	}
+
+	_, err = tx.Exec(stmt,
+		sql.Named("thumbname", thumbname),
+		sql.Named("faceversion", faceVersion))
+	return err
+}
+
+// The rest of evaluating filename, once its faces are checked
+func (e *Evaluator) evaluate(db *sql.DB, filename string) error {
+	err := assess(db, e.store, filename)
+	if err != nil {
+		return err
+	}
+
+	err = e.autotag(db, filename)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`update mediastat set
 			facechecked = 1
 			where filename = :filename;`,
@@ -331,3 +642,65 @@ func (e *Evaluator) evaluate(db *sql.DB, filename string) error {
 
 	return nil
 }
+
+// Rates the thumbnails of filename which haven't been rated yet
+// Thumbnails that can't be read get zeros rather than being retried forever
+func assess(db *sql.DB, store thumbstore.ThumbStore, filename string) error {
+	thumbnames, err := util.AllRows1[string](db, `
+		select thumbname
+		from thumbnail
+		where (aesthetic is null or focus_x is null)
+		and thumbname in (
+			select thumbname
+			from thumbmap
+			where filename = :filename);
+		`, sql.Named("filename", filename))
+	if err != nil {
+		return err
+	}
+
+	for _, thumbname := range thumbnames {
+		var rating avc.Aesthetic
+		b, err := store.Get(thumbname)
+		if err == nil {
+			rating, err = avc.AssessImageBuf(b)
+		}
+		if err != nil {
+			log.Printf("%s: %s", thumbname, err)
+			rating.Focus = avc.Point{X: 0.5, Y: 0.5}
+		}
+
+		_, err = db.Exec(`
+			update thumbnail set
+				sharpness = :sharpness,
+				exposure = :exposure,
+				colourfulness = :colourfulness,
+				aesthetic = :aesthetic,
+				focus_x = :focus_x,
+				focus_y = :focus_y
+			where thumbname = :thumbname;`,
+			sql.Named("thumbname", thumbname),
+			sql.Named("sharpness", rating.Sharpness),
+			sql.Named("exposure", rating.Exposure),
+			sql.Named("colourfulness", rating.Colourfulness),
+			sql.Named("aesthetic", rating.Aesthetic),
+			sql.Named("focus_x", rating.Focus.X),
+			sql.Named("focus_y", rating.Focus.Y))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Landmarks are kept as JSON, [[x, y], ...], the watch page reads them with json_each
+func encodeLandmarks(points []avc.Point) (string, error) {
+	pairs := make([][2]float32, len(points))
+	for i, point := range points {
+		pairs[i] = [2]float32{point.X, point.Y}
+	}
+
+	b, err := json.Marshal(pairs)
+	return string(b), err
+}
@@ -0,0 +1,299 @@
+//Thumbnail garbage collection
+// Culling only ever removes rows, the files in the ThumbStore are left behind
+// Thumbnails are named by digest and shared between files (duplicates), so a file is only garbage
+// once nothing at all refers to it
+//
+// In order:
+//   thumbnail rows no file maps to
+//   rows whose file in the store has gone
+//   files in the store no row refers to, including size variants
+
+package av
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/jml-89/http-server-av/internal/thumbstore"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+type GCMode string
+
+const (
+	GCOff        GCMode = "off"
+	GCReport     GCMode = "report"     // find garbage but touch nothing
+	GCDelete     GCMode = "delete"     // remove it
+	GCQuarantine GCMode = "quarantine" // move files under quarantine/ in the store, rows are still removed
+)
+
+var GCModes = []GCMode{GCOff, GCReport, GCDelete, GCQuarantine}
+
+// Files written this recently might belong to a row that isn't committed yet
+var gcGrace = time.Hour
+
+type GCResult struct {
+	Rows  int
+	Files int
+	Bytes int64
+}
+
+func (r GCResult) String() string {
+	return fmt.Sprintf("%d rows, %d files, %.1f MiB", r.Rows, r.Files, float64(r.Bytes)/(1024*1024))
+}
+
+func ThumbGC(db *sql.DB, store thumbstore.ThumbStore, mode GCMode) (GCResult, error) {
+	var res GCResult
+
+	if mode == GCOff {
+		return res, nil
+	}
+
+	if !slices.Contains(GCModes, mode) {
+		return res, fmt.Errorf("Unknown GC mode %s", mode)
+	}
+
+	n, err := gcUnmappedRows(db, mode)
+	if err != nil {
+		return res, err
+	}
+	res.Rows += n
+
+	n, err = gcVanishedRows(db, store, mode)
+	if err != nil {
+		return res, err
+	}
+	res.Rows += n
+
+	files, bytes, err := gcFiles(db, store, mode)
+	if err != nil {
+		return res, err
+	}
+	res.Files += files
+	res.Bytes += bytes
+
+	return res, nil
+}
+
+// Thumbnails left behind by cullMissing and the like
+func gcUnmappedRows(db *sql.DB, mode GCMode) (int, error) {
+	thumbnames, err := util.AllRows1[string](db, `
+		select thumbname
+		from thumbnail
+		where thumbname not in (
+			select thumbname
+			from thumbmap);`)
+	if err != nil {
+		return 0, err
+	}
+
+	if mode == GCReport {
+		return len(thumbnames), nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, thumbname := range thumbnames {
+		for _, stmt := range []string{
+			`delete from thumbface where thumbname = :thumbname;`,
+			`delete from thumbtag where thumbname = :thumbname;`,
+			`delete from thumbnail where thumbname = :thumbname;`,
+		} {
+			_, err = tx.Exec(stmt, sql.Named("thumbname", thumbname))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(thumbnames), tx.Commit()
+}
+
+// Rows pointing at files which are no longer in the store
+// Thumbnails go entirely, previews and sprite sheets go so they're made again
+func gcVanishedRows(db *sql.DB, store thumbstore.ThumbStore, mode GCMode) (int, error) {
+	// Errors count as present, better to keep a row than drop it on a hiccup
+	missing := func(name string) bool {
+		ok, err := store.Has(name)
+		return err == nil && !ok
+	}
+
+	thumbnames, err := util.AllRows1[string](db, `select thumbname from thumbnail;`)
+	if err != nil {
+		return 0, err
+	}
+
+	previews, err := util.AllRows1[string](db, `select previewname from preview where previewname != '';`)
+	if err != nil {
+		return 0, err
+	}
+
+	sheets, err := util.AllRows1[string](db, `select sheetname from spritesheet where sheetname != '';`)
+	if err != nil {
+		return 0, err
+	}
+
+	type deletion struct {
+		stmts []string
+		name  string
+	}
+
+	deletions := make([]deletion, 0, 10)
+	for _, thumbname := range thumbnames {
+		if missing(thumbname) {
+			deletions = append(deletions, deletion{name: thumbname, stmts: []string{
+				`delete from thumbface where thumbname = :name;`,
+				`delete from thumbtag where thumbname = :name;`,
+				`delete from thumbnail where thumbname = :name;`,
+				`delete from thumbmap where thumbname = :name;`,
+			}})
+		}
+	}
+	for _, previewname := range previews {
+		if missing(previewname) {
+			deletions = append(deletions, deletion{name: previewname, stmts: []string{
+				`delete from preview where previewname = :name;`,
+			}})
+		}
+	}
+	for _, sheetname := range sheets {
+		if missing(sheetname) {
+			deletions = append(deletions, deletion{name: sheetname, stmts: []string{
+				`delete from spritesheet where sheetname = :name;`,
+			}})
+		}
+	}
+
+	if mode == GCReport || len(deletions) == 0 {
+		return len(deletions), nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, del := range deletions {
+		for _, stmt := range del.stmts {
+			_, err = tx.Exec(stmt, sql.Named("name", del.name))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Files which lost their best thumbnail pick again from what's left in RescoreAll
+	// Ones with nothing left score 0, so the improver gets to them
+	// A pin on a thumbnail that's gone doesn't mean anything any more
+	_, err = tx.Exec(`
+		update mediastat set
+			bestthumb = '',
+			bestscore = 0,
+			pinned = 0
+		where bestthumb != ''
+		and bestthumb not in (
+			select thumbname
+			from thumbnail);`)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(deletions), RescoreAll(db)
+}
+
+// Blobs in the store nothing refers to
+// Size and crop variants go along with the thumbnail they're a variant of
+// Anything in a directory that isn't a variant's (quarantine, say) is left alone
+func gcFiles(db *sql.DB, store thumbstore.ThumbStore, mode GCMode) (int, int64, error) {
+	// thumbmap rather than thumbnail, so a report counts the files of unmapped rows too
+	names, err := util.AllRows1[string](db, `
+		select thumbname from thumbmap
+		union
+		select previewname from preview
+		union
+		select sheetname from spritesheet;`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	referenced := make(map[string]bool, len(names))
+	for _, name := range names {
+		referenced[name] = true
+	}
+
+	dirs := variantDirs()
+
+	garbage := make([]thumbstore.Entry, 0, 100)
+	err = store.Walk(func(entry thumbstore.Entry) error {
+		dir, base := path.Dir(entry.Name), path.Base(entry.Name)
+		if !slices.Contains(dirs, dir) || referenced[base] {
+			return nil
+		}
+
+		if time.Since(entry.ModTime) < gcGrace {
+			return nil
+		}
+
+		garbage = append(garbage, entry)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count := 0
+	bytes := int64(0)
+	for _, entry := range garbage {
+		err = gcFile(store, entry.Name, mode)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Gone already
+			continue
+		}
+		if err != nil {
+			return count, bytes, err
+		}
+
+		count += 1
+		bytes += entry.Size
+	}
+
+	return count, bytes, nil
+}
+
+func gcFile(store thumbstore.ThumbStore, name string, mode GCMode) error {
+	switch mode {
+	case GCDelete:
+		return store.Delete(name)
+
+	case GCQuarantine:
+		// Keeps the same layout under quarantine, variants could otherwise clash with originals
+		b, err := store.Get(name)
+		if err != nil {
+			return err
+		}
+
+		err = store.Put(path.Join("quarantine", name), b)
+		if err != nil {
+			return err
+		}
+
+		return store.Delete(name)
+	}
+
+	return nil
+}
@@ -0,0 +1,333 @@
+//People
+// Faces are grouped into people by how alike their embeddings are
+// Grouping is greedy and incremental, each new face joins the closest person or starts a new one
+// So people stay put as the library grows, and names given to them stick
+// Naming a person lists them against every file they're in (personfile), which is what makes person:"name" searches work
+
+package av
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+// Cosine similarity a face needs to a person's average to count as them
+// Erring high, two people split apart can be put back together by giving them the same name
+// Two people merged can't be pulled apart
+const personSimilarity = 0.5
+
+// Small, blurry and side-on faces give embeddings that could be anyone, they're left out
+const personMinQuality = 0.3
+
+type person struct {
+	id       int64
+	centroid []float32
+}
+
+// Sorts unassigned faces into people, returns how many were given one
+// Embeddings from different models can't be compared, so people belong to an embedversion
+// Changing the embedding model starts people over, names have to be given again
+func ClusterFaces(db *sql.DB, embedVersion string) (int, error) {
+	faceids, blobs, err := util.AllRows2[int64, []byte](db, `
+		select rowid, embedding
+		from thumbface
+		where personid is null
+		and quality >= :minquality
+		and length(embedding) > 0;`,
+		sql.Named("minquality", personMinQuality))
+	if err != nil {
+		return 0, err
+	}
+
+	people, err := loadPeople(db, embedVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for i, faceid := range faceids {
+		embedding := decodeEmbedding(blobs[i])
+
+		best := -1
+		bestSimilarity := personSimilarity
+		for j := range people {
+			similarity := cosine(embedding, people[j].centroid)
+			if similarity >= bestSimilarity {
+				best = j
+				bestSimilarity = similarity
+			}
+		}
+
+		if best < 0 {
+			res, err := tx.Exec(`insert into person (centroid, embedversion) values (:centroid, :embedversion);`,
+				sql.Named("centroid", encodeEmbedding(embedding)),
+				sql.Named("embedversion", embedVersion))
+			if err != nil {
+				return 0, err
+			}
+
+			id, err := res.LastInsertId()
+			if err != nil {
+				return 0, err
+			}
+
+			people = append(people, person{id: id, centroid: embedding})
+			best = len(people) - 1
+		} else {
+			// The centroid is the sum of the faces, cosine doesn't care about length
+			for k := range people[best].centroid {
+				people[best].centroid[k] += embedding[k]
+			}
+
+			_, err = tx.Exec(`update person set centroid = :centroid where id = :id;`,
+				sql.Named("id", people[best].id),
+				sql.Named("centroid", encodeEmbedding(people[best].centroid)))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		_, err = tx.Exec(`update thumbface set personid = :personid where rowid = :faceid;`,
+			sql.Named("personid", people[best].id),
+			sql.Named("faceid", faceid))
+		if err != nil {
+			return 0, err
+		}
+
+		count += 1
+	}
+
+	// Faces go when thumbnails are culled or looked at again, not only when they're clustered
+	err = refreshPeople(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
+
+// Brings people and personfile up to date with the faces there are now
+// For when faces may have changed but there's nothing to cluster them with
+func RefreshPeople(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = refreshPeople(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Giving a person the same name as another makes them one person
+// An empty name takes the name away
+func NamePerson(db *sql.DB, id int64, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var blob []byte
+	err = tx.QueryRow(`select centroid from person where id = :id;`,
+		sql.Named("id", id)).Scan(&blob)
+	if err != nil {
+		return err
+	}
+
+	var otherid int64
+	var otherBlob []byte
+	err = tx.QueryRow(`
+		select id, centroid
+		from person
+		where name = :name
+		and name != ''
+		and id != :id
+		and embedversion is (
+			select embedversion
+			from person
+			where id = :id)
+		limit 1;`,
+		sql.Named("id", id),
+		sql.Named("name", name)).Scan(&otherid, &otherBlob)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err == nil {
+		centroid := decodeEmbedding(otherBlob)
+		if added := decodeEmbedding(blob); len(added) == len(centroid) {
+			for k := range centroid {
+				centroid[k] += added[k]
+			}
+		}
+
+		stmts := []string{
+			`update thumbface set personid = :otherid where personid = :id;`,
+			`update person set centroid = :centroid where id = :otherid;`,
+			`delete from person where id = :id;`,
+		}
+		for _, stmt := range stmts {
+			_, err = tx.Exec(stmt,
+				sql.Named("id", id),
+				sql.Named("otherid", otherid),
+				sql.Named("centroid", encodeEmbedding(centroid)))
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		_, err = tx.Exec(`update person set name = :name where id = :id;`,
+			sql.Named("id", id),
+			sql.Named("name", name))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = refreshPersonFiles(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// A square crop of one face out of its thumbnail, faceid is the thumbface rowid
+func FaceCrop(db *sql.DB, store thumbstore.ThumbStore, faceid int64, size int) ([]byte, error) {
+	var thumbname string
+	var box avc.Box
+	err := db.QueryRow(`
+		select thumbname, box_x, box_y, box_w, box_h
+		from thumbface
+		where rowid = :faceid
+		and box_x is not null;`,
+		sql.Named("faceid", faceid)).Scan(&thumbname, &box.X, &box.Y, &box.W, &box.H)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("face %d: %w", faceid, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := store.Get(thumbname)
+	if err != nil {
+		return nil, err
+	}
+
+	return avc.CropImageBuf(b, box, size)
+}
+
+// People whose faces have all been culled go, unless someone went to the trouble of naming them
+func refreshPeople(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		delete from person
+		where name = ''
+		and id not in (
+			select personid
+			from thumbface
+			where personid is not null);`)
+	if err != nil {
+		return err
+	}
+
+	return refreshPersonFiles(tx)
+}
+
+// Every named person in a file's thumbnails, one row each
+// Kept apart from tags, a file can have its own person tag
+func refreshPersonFiles(tx *sql.Tx) error {
+	stmts := []string{
+		`delete from personfile;`,
+
+		`insert into personfile (filename, name)
+		select distinct a.filename, c.name
+		from thumbmap a
+		inner join thumbface b
+		on a.thumbname = b.thumbname
+		inner join person c
+		on b.personid = c.id
+		where c.name != '';`,
+	}
+
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadPeople(db *sql.DB, embedVersion string) ([]person, error) {
+	ids, blobs, err := util.AllRows2[int64, []byte](db, `
+		select id, centroid
+		from person
+		where embedversion is :embedversion;`,
+		sql.Named("embedversion", embedVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	people := make([]person, len(ids))
+	for i := range ids {
+		people[i] = person{id: ids[i], centroid: decodeEmbedding(blobs[i])}
+	}
+
+	return people, nil
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / math.Sqrt(na*nb)
+}
+
+// Embeddings are stored as little-endian float32s
+func encodeEmbedding(embedding []float32) []byte {
+	b := make([]byte, 4*len(embedding))
+	for i, x := range embedding {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return b
+}
+
+func decodeEmbedding(b []byte) []float32 {
+	embedding := make([]float32, len(b)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return embedding
+}
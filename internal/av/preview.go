@@ -0,0 +1,78 @@
+//Previews
+// Short animated clips shown when hovering over a video in the grid
+// Made lazily in the background so the initial scan isn't held up
+
+package av
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+const previewClips = 6
+
+func CreatePreview(pathIn string) ([]byte, error) {
+	return avc.CreateAnimatedPreview(pathIn, previewClips)
+}
+
+// Makes previews for up to limit videos which don't have one yet
+// Videos that fail get an empty previewname so they aren't tried again and again
+func MakePreviews(db *sql.DB, store thumbstore.ThumbStore, limit int) (int, error) {
+	count := 0
+
+	filenames, err := util.AllRows1[string](db, `
+		select filename
+		from mediastat
+		where canseek
+		and filename not in (
+			select filename
+			from preview)
+		and filename in (
+			select filename
+			from tags
+			where name = 'mediatype'
+			and val = 'video')
+		limit :limit;`, sql.Named("limit", limit))
+	if err != nil {
+		return count, err
+	}
+
+	for _, filename := range filenames {
+		previewName := ""
+
+		b, err := CreatePreview(filename)
+		if err != nil {
+			log.Printf("Failed to generate preview for %s: %s", filename, err)
+		} else {
+			digest, err := Checksum(b)
+			if err != nil {
+				return count, err
+			}
+
+			previewName = fmt.Sprintf("%s.webp", digest)
+			err = store.Put(previewName, b)
+			if err != nil {
+				return count, err
+			}
+		}
+
+		_, err = db.Exec(`
+			insert or replace into
+				preview (filename, previewname)
+				values (:filename, :previewname);`,
+			sql.Named("filename", filename),
+			sql.Named("previewname", previewName))
+		if err != nil {
+			return count, err
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
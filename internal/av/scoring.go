@@ -0,0 +1,315 @@
+//Scoring
+// How a thumbnail is scored, and what score is good enough to stop looking for better
+// Both are SQL expressions kept in the database, so each library can be tuned without a rebuild
+//
+// The score expression is evaluated per thumbnail and can use its columns:
+//   area, confidence, quality (faces)
+//   sharpness, exposure, colourfulness, aesthetic (image quality, null until assessed)
+//   pos (0.0 to 1.0 through the video, null when unknown)
+// The threshold expression is evaluated on its own, so can't use any of those
+//
+// Expressions come off a web form and get pasted into statements
+// So they're held to numbers, those columns, arithmetic and comparisons, and scoringFuncs
+// Anything else (strings, keywords, subqueries, comments) is turned away before it's stored
+
+package av
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+)
+
+var scoringDefaults = map[string]string{
+	"score":     "scorefn(area, confidence, quality, coalesce(aesthetic, 0.0))",
+	"threshold": "scorefn(30000, 0.85, 0.6, 0.0)",
+}
+
+// Stored in place of the default, so a changed default reaches existing databases
+const scoringDefault = "default"
+
+var scoringColumns = map[string][]string{
+	"score":     {"area", "confidence", "quality", "sharpness", "exposure", "colourfulness", "aesthetic", "pos"},
+	"threshold": {},
+}
+
+var scoringFuncs = []string{"scorefn", "sqrt", "abs", "min", "max", "coalesce", "round"}
+
+// One token at a time: a number, a name, or an operator
+var scoringToken = regexp.MustCompile(`^(?:(\d+(?:\.\d*)?(?:[eE][+-]?\d+)?|\.\d+(?:[eE][+-]?\d+)?)|([A-Za-z_][A-Za-z0-9_]*)|(<=|>=|==|!=|<>|[-+*/%(),<>=]))`)
+
+// What's stored, the marker included
+func storedScoring(db *sql.DB, name string) (string, error) {
+	var expr string
+	err := db.QueryRow(`select expr from scoring where name = :name;`,
+		sql.Named("name", name)).Scan(&expr)
+	return expr, err
+}
+
+// What's stored, ready to paste into a statement
+// Checked again here, the table might predate the checks or have been edited by hand
+func scoringExpr(db *sql.DB, name string) (string, error) {
+	expr, err := storedScoring(db, name)
+	if err != nil {
+		return "", err
+	}
+
+	if expr == scoringDefault {
+		return scoringDefaults[name], nil
+	}
+
+	err = lexScoringExpr(name, expr)
+	if err != nil {
+		return "", err
+	}
+
+	return expr, nil
+}
+
+// Stored expressions that don't pass the checks any more go back to the default
+func resetBadScoring(tx *sql.Tx) error {
+	for name := range scoringDefaults {
+		var expr string
+		err := tx.QueryRow(`select expr from scoring where name = :name;`,
+			sql.Named("name", name)).Scan(&expr)
+		if err != nil {
+			return err
+		}
+
+		if expr == scoringDefault || lexScoringExpr(name, expr) == nil {
+			continue
+		}
+
+		log.Printf("Scoring expression %s reset to the default, %s isn't allowed", name, expr)
+		_, err = tx.Exec(`update scoring set expr = :expr where name = :name;`,
+			sql.Named("name", name),
+			sql.Named("expr", scoringDefault))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The score an Improver will stop probing at
+func ScoreThreshold(db *sql.DB) (float64, error) {
+	expr, err := scoringExpr(db, "threshold")
+	if err != nil {
+		return 0, err
+	}
+
+	var threshold float64
+	err = db.QueryRow(fmt.Sprintf(`select (%s);`, expr)).Scan(&threshold)
+	return threshold, err
+}
+
+// The best score a thumbnail without faces can get, a perfect aesthetic halfway through
+// Anything scoring above this found something aesthetics alone can't give
+// Probes only know their aesthetic, so an expression using the other image columns or pos
+// can't be bounded this way, and there's no ceiling (Valid false)
+func AestheticCeiling(db *sql.DB) (sql.NullFloat64, error) {
+	expr, err := scoringExpr(db, "score")
+	if err != nil {
+		return sql.NullFloat64{}, err
+	}
+
+	for _, column := range scoringNames(expr) {
+		if slices.Contains(unboundedColumns, column) {
+			return sql.NullFloat64{}, nil
+		}
+	}
+
+	scores, err := probeScores(db, []avc.Probe{{Pos: 0.5, Aesthetic: 1}})
+	if err != nil {
+		return sql.NullFloat64{}, err
+	}
+
+	return sql.NullFloat64{Float64: scores[0], Valid: true}, nil
+}
+
+// Columns AestheticCeiling doesn't know the best value of
+var unboundedColumns = []string{"sharpness", "exposure", "colourfulness", "pos"}
+
+// The columns an expression uses, lowercased, function names left out
+// Only for expressions that have been through lexScoringExpr
+func scoringNames(expr string) []string {
+	names := make([]string, 0, 8)
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		m := scoringToken.FindStringSubmatch(rest)
+		if m == nil {
+			break
+		}
+		rest = strings.TrimSpace(rest[len(m[0]):])
+
+		if m[2] != "" && !strings.HasPrefix(rest, "(") {
+			names = append(names, strings.ToLower(m[2]))
+		}
+	}
+	return names
+}
+
+// Only lets through what the package comment allows
+// Parentheses have to balance, so an expression can't close the statement's own
+func lexScoringExpr(name, expr string) error {
+	if strings.TrimSpace(expr) == "" {
+		return errors.New("Empty expression")
+	}
+
+	if strings.Contains(expr, "--") || strings.Contains(expr, "/*") {
+		return fmt.Errorf("%s: comments aren't allowed", expr)
+	}
+
+	depth := 0
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		m := scoringToken.FindStringSubmatch(rest)
+		if m == nil {
+			return fmt.Errorf("%s: unexpected %q", expr, rest[:1])
+		}
+		rest = strings.TrimSpace(rest[len(m[0]):])
+
+		switch {
+		case m[2] != "":
+			word := strings.ToLower(m[2])
+			if strings.HasPrefix(rest, "(") {
+				if !slices.Contains(scoringFuncs, word) {
+					return fmt.Errorf("%s: no function called %s, expected one of %s", expr, m[2], strings.Join(scoringFuncs, ", "))
+				}
+			} else if !slices.Contains(scoringColumns[name], word) {
+				return fmt.Errorf("%s: %s can't be used in %s", expr, m[2], name)
+			}
+
+		case m[3] == "(":
+			depth++
+
+		case m[3] == ")":
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("%s: unbalanced parentheses", expr)
+			}
+		}
+	}
+
+	if depth != 0 {
+		return fmt.Errorf("%s: unbalanced parentheses", expr)
+	}
+
+	return nil
+}
+
+// Checks an expression gives a number before it's let anywhere near the thumbnail table
+// Nulls are let through, scores are coalesced to 0 when applied
+func checkScoringExpr(db *sql.DB, name, expr string) error {
+	if _, ok := scoringColumns[name]; !ok {
+		return fmt.Errorf("No scoring expression called %s", name)
+	}
+
+	err := lexScoringExpr(name, expr)
+	if err != nil {
+		return err
+	}
+
+	var query string
+	switch name {
+	case "score":
+		query = fmt.Sprintf(`
+			select (%s)
+			from (
+				select
+					30000 as area,
+					0.85 as confidence,
+					0.6 as quality,
+					0.5 as sharpness,
+					0.5 as exposure,
+					0.5 as colourfulness,
+					0.5 as aesthetic,
+					0.5 as pos
+			);`, expr)
+	case "threshold":
+		query = fmt.Sprintf(`select (%s);`, expr)
+	}
+
+	var result sql.NullFloat64
+	err = db.QueryRow(query).Scan(&result)
+	if err != nil {
+		return fmt.Errorf("%s: %s", expr, err)
+	}
+
+	if name == "threshold" && !result.Valid {
+		return fmt.Errorf("%s: threshold is null", expr)
+	}
+
+	return nil
+}
+
+// Replaces a scoring expression, an empty expr (or "default") goes back to the default
+// Everything is rescored if the score expression actually changed
+func SetScoring(db *sql.DB, name, expr string) error {
+	def, ok := scoringDefaults[name]
+	if !ok {
+		return fmt.Errorf("No scoring expression called %s", name)
+	}
+
+	expr = strings.TrimSpace(expr)
+	if expr == "" || expr == scoringDefault {
+		expr = scoringDefault
+	} else {
+		err := checkScoringExpr(db, name, expr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if expr == def {
+		expr = scoringDefault
+	}
+
+	current, err := storedScoring(db, name)
+	if err != nil {
+		return err
+	}
+
+	if current == expr {
+		return nil
+	}
+
+	_, err = db.Exec(`
+		insert or replace into
+			scoring (name, expr)
+			values (:name, :expr);`,
+		sql.Named("name", name),
+		sql.Named("expr", expr))
+	if err != nil {
+		return err
+	}
+
+	if name != "score" {
+		return nil
+	}
+
+	// Passing the check doesn't guarantee it works on every real thumbnail
+	// Put the old one back rather than leave a broken expression stored
+	err = RescoreAll(db)
+	if err != nil {
+		_, errRestore := db.Exec(`
+			update scoring
+			set expr = :expr
+			where name = :name;`,
+			sql.Named("name", name),
+			sql.Named("expr", current))
+		if errRestore != nil {
+			return errRestore
+		}
+		return err
+	}
+
+	return nil
+}
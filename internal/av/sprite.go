@@ -0,0 +1,84 @@
+//Sprite sheets
+// Tiled frames at a fixed interval for previewing while scrubbing the seek bar
+// Made lazily in the background, same as previews
+
+package av
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+// Seconds between tiles, long videos will get a longer one (see avc.CreateSpriteSheet)
+const spriteInterval = 10.0
+
+func CreateSpriteSheet(pathIn string) ([]byte, avc.SpriteSheet, error) {
+	return avc.CreateSpriteSheet(pathIn, spriteInterval)
+}
+
+// Makes sprite sheets for up to limit videos which don't have one yet
+// Videos that fail get an empty sheetname so they aren't tried again and again
+func MakeSpriteSheets(db *sql.DB, store thumbstore.ThumbStore, limit int) (int, error) {
+	count := 0
+
+	filenames, err := util.AllRows1[string](db, `
+		select filename
+		from mediastat
+		where canseek
+		and filename not in (
+			select filename
+			from spritesheet)
+		and filename in (
+			select filename
+			from tags
+			where name = 'mediatype'
+			and val = 'video')
+		limit :limit;`, sql.Named("limit", limit))
+	if err != nil {
+		return count, err
+	}
+
+	for _, filename := range filenames {
+		sheetName := ""
+
+		b, sheet, err := CreateSpriteSheet(filename)
+		if err != nil {
+			log.Printf("Failed to generate sprite sheet for %s: %s", filename, err)
+		} else {
+			digest, err := Checksum(b)
+			if err != nil {
+				return count, err
+			}
+
+			sheetName = fmt.Sprintf("%s.webp", digest)
+			err = store.Put(sheetName, b)
+			if err != nil {
+				return count, err
+			}
+		}
+
+		_, err = db.Exec(`
+			insert or replace into
+				spritesheet (filename, sheetname, interval, count, columns, tilew, tileh)
+				values (:filename, :sheetname, :interval, :count, :columns, :tilew, :tileh);`,
+			sql.Named("filename", filename),
+			sql.Named("sheetname", sheetName),
+			sql.Named("interval", sheet.Interval),
+			sql.Named("count", sheet.Count),
+			sql.Named("columns", sheet.Columns),
+			sql.Named("tilew", sheet.TileW),
+			sql.Named("tileh", sheet.TileH))
+		if err != nil {
+			return count, err
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
@@ -16,8 +16,8 @@ import (
 	"log"
 	"os"
 	"strings"
-	"path/filepath"
 
+	"github.com/jml-89/http-server-av/internal/thumbstore"
 	"github.com/jml-89/http-server-av/internal/util"
 )
 
@@ -43,6 +43,9 @@ func InitDB(db *sql.DB) error {
 			facechecked integer not null,
 			bestthumb text not null,
 			bestscore real not null,
+			candidates integer not null default 0,
+			pinned integer not null default 0,
+			swept integer not null default 0,
 			primary key (filename)
 		);`,
 
@@ -69,11 +72,87 @@ func InitDB(db *sql.DB) error {
 			thumbname text not null,
 			area integer not null,
 			confidence real not null,
-			quality real not null
+			quality real not null,
+			box_x real,
+			box_y real,
+			box_w real,
+			box_h real,
+			embedding blob,
+			personid integer,
+			landmarks text
 		);`,
 
 		`create index if not exists thumbface_thumbname_idx on thumbface(thumbname);`,
 
+		`create table if not exists thumbtag (
+			thumbname text,
+			label text,
+			confidence real not null,
+			primary key (thumbname, label)
+		);`,
+
+		`create table if not exists autotag (
+			filename text,
+			label text,
+			confidence real not null,
+			primary key (filename, label)
+		);`,
+
+		`create table if not exists person (
+			id integer primary key,
+			name text not null default '',
+			centroid blob not null,
+			embedversion text
+		);`,
+
+		`create table if not exists personfile (
+			filename text,
+			name text,
+			primary key (filename, name)
+		);`,
+
+		// Searches go through this, so autotag:"dog" and person:"name" work like any other tag
+		// Made again every time, older databases have it without people
+		`drop view if exists searchtags;`,
+
+		`create view searchtags (filename, name, val, rowid) as
+			select filename, name, val, rowid from tags
+			union all
+			select filename, 'autotag', label, rowid from autotag
+			union all
+			select filename, 'person', name, rowid from personfile;`,
+
+		`create table if not exists preview (
+			filename text,
+			previewname text not null,
+			primary key (filename)
+		);`,
+
+		`create table if not exists spritesheet (
+			filename text,
+			sheetname text not null,
+			interval real not null,
+			count integer not null,
+			columns integer not null,
+			tilew integer not null,
+			tileh integer not null,
+			primary key (filename)
+		);`,
+
+		`create table if not exists thumbcandidate (
+			filename text,
+			pos real,
+			promise real not null,
+			probed integer not null,
+			primary key (filename, pos)
+		);`,
+
+		`create table if not exists scoring (
+			name text,
+			expr text not null,
+			primary key (name)
+		);`,
+
 		`create table if not exists wordassocs (
 			filename text,
 			word text,
@@ -90,6 +169,16 @@ func InitDB(db *sql.DB) error {
 			confidence real not null,
 			quality real not null,
 			score real not null,
+			pos real,
+			sharpness real,
+			exposure real,
+			colourfulness real,
+			aesthetic real,
+			faceversion text,
+			tagversion text,
+			focus_x real,
+			focus_y real,
+			variants integer not null default 0,
 			primary key (thumbname)
 		);`,
 	}
@@ -102,6 +191,76 @@ func InitDB(db *sql.DB) error {
 		}
 	}
 
+	for _, added := range addedColumns {
+		err = addColumn(tx, added[0], added[1], added[2])
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	// Autotags used to be one comma separated tag, files which still have it get rows instead
+	migrations := []string{
+		`insert or ignore into autotag (filename, label, confidence)
+		select a.filename, b.label, max(b.confidence)
+		from thumbmap a
+		inner join thumbtag b
+		on a.thumbname = b.thumbname
+		where a.filename in (
+			select filename
+			from tags
+			where name = 'autotag')
+		group by a.filename, b.label;`,
+
+		`delete from tags where name = 'autotag';`,
+
+		// People used to be a tag too, only the ones that match what was written go
+		// A file's own person tag is left alone
+		`delete from tags
+		where name = 'person'
+		and val is (
+			select group_concat(distinct c.name)
+			from thumbmap a
+			inner join thumbface b
+			on a.thumbname = b.thumbname
+			inner join person c
+			on b.personid = c.id
+			where c.name != ''
+			and a.filename = tags.filename);`,
+	}
+
+	for _, migration := range migrations {
+		_, err = tx.Exec(migration)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	// Databases from before the marker have the default's text, which is swapped for the marker
+	for name, expr := range scoringDefaults {
+		_, err = tx.Exec(`
+			insert into
+				scoring (name, expr)
+				values (:name, :marker)
+			on conflict (name) do update
+				set expr = :marker
+				where expr = :expr;`,
+			sql.Named("name", name),
+			sql.Named("expr", expr),
+			sql.Named("marker", scoringDefault))
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	err = resetBadScoring(tx)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Println(err)
@@ -117,26 +276,69 @@ func InitDB(db *sql.DB) error {
 	return nil
 }
 
-func insertThumbnail(tx *sql.Tx, filename string, thumbnail Thumbnail) error {
-	err := os.Mkdir(".thumbs", 0777)
-	if err != nil && !os.IsExist(err) {
-		log.Println(err)
+// Columns which came along after their table was first released
+// "create table if not exists" leaves existing databases without them
+// So they're added here too, if missing
+// table, column, column definition
+var addedColumns = [][3]string{
+	{"thumbnail", "pos", "real"},
+	{"mediastat", "candidates", "integer not null default 0"},
+	{"thumbnail", "sharpness", "real"},
+	{"thumbnail", "exposure", "real"},
+	{"thumbnail", "colourfulness", "real"},
+	{"thumbnail", "aesthetic", "real"},
+	{"mediastat", "pinned", "integer not null default 0"},
+	{"thumbface", "box_x", "real"},
+	{"thumbface", "box_y", "real"},
+	{"thumbface", "box_w", "real"},
+	{"thumbface", "box_h", "real"},
+	{"thumbface", "embedding", "blob"},
+	{"thumbface", "personid", "integer"},
+	{"thumbnail", "faceversion", "text"},
+	{"thumbface", "landmarks", "text"},
+	{"thumbnail", "tagversion", "text"},
+	{"person", "embedversion", "text"},
+	{"thumbnail", "focus_x", "real"},
+	{"thumbnail", "focus_y", "real"},
+	{"mediastat", "swept", "integer not null default 0"},
+	{"thumbnail", "variants", "integer not null default 0"},
+}
+
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var count int
+	err := tx.QueryRow(`
+		select count(*)
+		from pragma_table_info(:table)
+		where name = :column;`,
+		sql.Named("table", table),
+		sql.Named("column", column)).Scan(&count)
+	if err != nil {
 		return err
 	}
 
+	if count > 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("alter table %s add column %s %s;", table, column, definition))
+	return err
+}
+
+// Everything image-like (thumbnails, previews, sprite sheets) goes in the ThumbStore, named by digest
+func insertThumbnail(tx *sql.Tx, store thumbstore.ThumbStore, filename string, thumbnail Thumbnail) error {
 	thumbName := fmt.Sprintf("%s.webp", thumbnail.digest)
-	thumbPath := filepath.Join(".thumbs", thumbName)
-	err = os.WriteFile(thumbPath, thumbnail.image, 0666)
+	err := store.Put(thumbName, thumbnail.image)
 	if err != nil {
 		return err
 	}
 
 	_, err = tx.Exec(`
 		insert or replace into 
-			thumbnail (thumbname, facechecked, area, confidence, quality, score) 
-			values (:filename, 0, 0, 0, 0, 0);
+			thumbnail (thumbname, facechecked, area, confidence, quality, score, pos) 
+			values (:filename, 0, 0, 0, 0, 0, :pos);
 		`,
-		sql.Named("filename", thumbName))
+		sql.Named("filename", thumbName),
+		sql.Named("pos", thumbnail.pos))
 	if err != nil {
 		return err
 	}
@@ -213,10 +415,15 @@ func cullMissing(db *sql.DB) error {
 
 	delqueries := []string{
 		"delete from tags where filename is ?;",
+		"delete from autotag where filename is ?;",
+		"delete from personfile where filename is ?;",
 		"delete from wordassocs where filename is ?;",
 		"delete from filestat where filename is ?;",
 		"delete from mediastat where filename is ?;",
 		"delete from thumbmap where filename is ?;",
+		"delete from preview where filename is ?;",
+		"delete from spritesheet where filename is ?;",
+		"delete from thumbcandidate where filename is ?;",
 	}
 
 	count := 0
@@ -12,6 +12,8 @@ import (
 	"sync"
 	"path/filepath"
 	"strings"
+
+	"github.com/jml-89/http-server-av/internal/thumbstore"
 )
 
 type request struct {
@@ -28,7 +30,7 @@ type reply struct {
 // Majority of this function is orchestrating the goroutines
 // There may be opportunity to expand some error handling
 // However have not seen enough errors in testing to work on
-func AddFilesToDB(db *sql.DB, ignore []string, numWorkers int, path string) (int, error) {
+func AddFilesToDB(db *sql.DB, store thumbstore.ThumbStore, ignore []string, numWorkers int, path string) (int, error) {
 	count := 0
 
 	allFiles, err := recls(path, ignore)
@@ -45,7 +47,7 @@ func AddFilesToDB(db *sql.DB, ignore []string, numWorkers int, path string) (int
 		return count, nil
 	}
 
-	count, err = orchestrateParsers(db, numWorkers, filenames)
+	count, err = orchestrateParsers(db, store, numWorkers, filenames)
 	if err != nil {
 		return count, err
 	}
@@ -68,7 +70,7 @@ func AddFilesToDB(db *sql.DB, ignore []string, numWorkers int, path string) (int
 	return count, err
 }
 
-func orchestrateParsers(db *sql.DB, numWorkers int, filenames []string) (int, error) {
+func orchestrateParsers(db *sql.DB, store thumbstore.ThumbStore, numWorkers int, filenames []string) (int, error) {
 	count := 0
 
 	replies := make(chan reply)
@@ -96,7 +98,7 @@ func orchestrateParsers(db *sql.DB, numWorkers int, filenames []string) (int, er
 	}()
 
 	for reply := range replies {
-		err := insertReply(db, reply)
+		err := insertReply(db, store, reply)
 		if err != nil {
 			log.Println(err)
 			return count, err
@@ -108,7 +110,7 @@ func orchestrateParsers(db *sql.DB, numWorkers int, filenames []string) (int, er
 	return count, nil
 }
 
-func insertReply(db *sql.DB, reply reply) error {
+func insertReply(db *sql.DB, store thumbstore.ThumbStore, reply reply) error {
 	if errors.Is(reply.err, os.ErrNotExist) {
 		return nil
 	}
@@ -137,7 +139,7 @@ func insertReply(db *sql.DB, reply reply) error {
 	}
 	defer tx.Rollback()
 
-	err = insertMedia(tx, []Thumbnail{reply.payload.thumbnail}, reply.payload.metadata)
+	err = insertMedia(tx, store, []Thumbnail{reply.payload.thumbnail}, reply.payload.metadata)
 	if err != nil {
 		return err
 	}
@@ -191,11 +193,17 @@ func parser(requests <-chan request, replies chan<- reply) {
 	}
 }
 
-func recls(dir string, ignores []string) (map[string]os.FileInfo, error) {
+// ignores are paths relative to root, e.g. a thumbnail directory somewhere inside it
+func recls(root string, ignores []string) (map[string]os.FileInfo, error) {
 	files := make(map[string]os.FileInfo)
 
 	badSuffixes := []string{"-wal", "-shm", "-journal"}
 
+	cleaned := make([]string, len(ignores))
+	for i, ignore := range ignores {
+		cleaned[i] = filepath.Clean(ignore)
+	}
+
 	var ls func(string) error
 	ls = func(dir string) error {
 		entries, err := os.ReadDir(dir)
@@ -204,9 +212,16 @@ func recls(dir string, ignores []string) (map[string]os.FileInfo, error) {
 		}
 
 		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
 			ok := true
-			for _, ignore := range ignores {
-				if entry.Name() == ignore {
+			for _, ignore := range cleaned {
+				if rel == ignore {
 					ok = false
 					break
 				}
@@ -216,7 +231,6 @@ func recls(dir string, ignores []string) (map[string]os.FileInfo, error) {
 				continue
 			}
 
-			path := filepath.Join(dir, entry.Name())
 			if entry.IsDir() {
 				err = ls(path)
 				if err != nil {
@@ -245,7 +259,7 @@ func recls(dir string, ignores []string) (map[string]os.FileInfo, error) {
 		return nil
 	}
 
-	err := ls(dir)
+	err := ls(root)
 
 	return files, err
 }
@@ -255,9 +269,9 @@ func recls(dir string, ignores []string) (map[string]os.FileInfo, error) {
 // But how many rows at once? I do not know
 // This has performed pretty reasonably in any case
 // The limiting performance factor is elsewhere (handling media files)
-func insertMedia(tx *sql.Tx, thumbnails []Thumbnail, metadata map[string]string) error {
+func insertMedia(tx *sql.Tx, store thumbstore.ThumbStore, thumbnails []Thumbnail, metadata map[string]string) error {
 	for _, thumbnail := range thumbnails {
-		err := insertThumbnail(tx, metadata["diskfilename"], thumbnail)
+		err := insertThumbnail(tx, store, metadata["diskfilename"], thumbnail)
 		if err != nil {
 			log.Println(err)
 			return err
@@ -6,8 +6,14 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/mattn/go-sqlite3"
+	"io/fs"
+	"math"
 	"os"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/jml-89/http-server-av/internal/thumbstore"
 	"github.com/jml-89/http-server-av/internal/util"
 )
 
@@ -29,7 +35,7 @@ func TestAddRemoveFiles(t *testing.T) {
 	//Subtitles are media-adjacent, ffmpeg will read them as media
 	pathSub := createSubtitleFile(t, pathDir)
 
-	n, err := AddFilesToDB(db, []string{}, 1, pathDir)
+	n, err := AddFilesToDB(db, thumbstore.NewMemStore(), []string{}, 1, pathDir)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,21 +97,455 @@ func TestAddRemoveFiles(t *testing.T) {
 	}
 }
 
+// Thumbnail files nothing refers to are collected, ones still referenced anywhere are kept
+// Shared thumbnails survive one of their files being culled
+func TestThumbGC(t *testing.T) {
+	db, pathDir := createTestEnv(t)
+	defer db.Close()
+	defer os.RemoveAll(pathDir)
+
+	// Everything in the store was just written, no grace period wanted here
+	defer func(grace time.Duration) { gcGrace = grace }(gcGrace)
+	gcGrace = 0
+
+	store := thumbstore.NewMemStore()
+	for _, name := range []string{"shared.webp", "orphan.webp", "360/orphan.webp"} {
+		err := store.Put(name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stmts := []string{
+		`insert into thumbnail (thumbname, facechecked, area, confidence, quality, score)
+			values ('shared.webp', 1, 0, 0, 0, 0), ('vanished.webp', 1, 0, 0, 0, 0);`,
+		`insert into thumbmap (filename, thumbname)
+			values ('a.mkv', 'shared.webp'), ('b.mkv', 'shared.webp'), ('a.mkv', 'vanished.webp');`,
+	}
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ThumbCull(db, "b.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ThumbGC(db, store, GCReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != 1 || res.Files != 2 {
+		t.Fatalf("report: expected 1 row and 2 files, got %s", res)
+	}
+
+	ok, err := store.Has("orphan.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("report mode removed a file")
+	}
+
+	res, err = ThumbGC(db, store, GCQuarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != 1 || res.Files != 2 {
+		t.Fatalf("quarantine: expected 1 row and 2 files, got %s", res)
+	}
+
+	for name, expected := range map[string]bool{
+		"shared.webp":                true,
+		"orphan.webp":                false,
+		"quarantine/orphan.webp":     true,
+		"quarantine/360/orphan.webp": true,
+	} {
+		ok, err := store.Has(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Fatalf("%s: expected present %t, got %t", name, expected, ok)
+		}
+	}
+
+	var count int
+	err = db.QueryRow(`select count(*) from thumbnail where thumbname = 'vanished.webp';`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("row for missing thumbnail file kept")
+	}
+}
+
+// Serving only reads what's cached, sizes and crops without a variant directory don't exist
+// Ones that haven't been made yet get the stored thumbnail
+func TestCachedVariant(t *testing.T) {
+	store := thumbstore.NewMemStore()
+	for name, content := range map[string]string{
+		"a.webp":          "540",
+		"360/a.webp":      "360",
+		"4x5/1080/a.webp": "4:5 1080",
+		"1x1/540/a.webp":  "1:1 540",
+	} {
+		err := store.Put(name, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		size     int
+		crop     string
+		expected string
+	}{
+		{0, "", "540"},
+		{360, "", "360"},
+		{720, "", "540"},
+		{1080, "4:5", "4:5 1080"},
+		{0, "1:1", "1:1 540"},
+		{180, "9:16", "540"},
+	}
+
+	for _, test := range tests {
+		b, err := CachedVariant(store, "a.webp", test.size, test.crop)
+		if err != nil {
+			t.Fatalf("%d %q: %s", test.size, test.crop, err)
+		}
+		if string(b) != test.expected {
+			t.Fatalf("%d %q: expected %s, got %s", test.size, test.crop, test.expected, b)
+		}
+	}
+
+	for _, test := range []struct {
+		size int
+		crop string
+	}{{500, ""}, {540, ""}, {500, "1:1"}, {360, "3:2"}, {360, "../.."}} {
+		_, err := CachedVariant(store, "a.webp", test.size, test.crop)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%d %q: expected not found, got %v", test.size, test.crop, err)
+		}
+	}
+}
+
+// Anything but numbers, columns, operators and scoringFuncs is turned away before it's stored
+// Empty goes back to the default, a failed rescore puts the old expression back
+func TestScoring(t *testing.T) {
+	db, pathDir := createTestEnv(t)
+	defer db.Close()
+	defer os.RemoveAll(pathDir)
+
+	good := []string{
+		scoringDefaults["score"],
+		"sqrt(area) * confidence + 50 * coalesce(aesthetic, 0)",
+		"(pos > 0.1) * 10 + 1.5e2",
+	}
+	for _, expr := range good {
+		err := checkScoringExpr(db, "score", expr)
+		if err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+	}
+
+	bad := []struct {
+		name string
+		expr string
+	}{
+		{"score", "1; drop table thumbnail"},
+		{"score", "(select max(score) from thumbnail)"},
+		{"score", "'text'"},
+		{"score", "randomblob(8)"},
+		{"score", "area) + (1"},
+		{"score", "area -- comment"},
+		{"score", "area /* comment */"},
+		{"score", "area +"},
+		{"threshold", "area"},
+		{"nonsense", "1"},
+	}
+	for _, test := range bad {
+		err := checkScoringExpr(db, test.name, test.expr)
+		if err == nil {
+			t.Fatalf("%s: %s accepted", test.name, test.expr)
+		}
+
+		err = SetScoring(db, test.name, test.expr)
+		if err == nil {
+			t.Fatalf("%s: %s stored", test.name, test.expr)
+		}
+	}
+
+	stored := func(name string) string {
+		expr, err := storedScoring(db, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return expr
+	}
+
+	err := SetScoring(db, "score", "aesthetic * 100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr := stored("score"); expr != "aesthetic * 100" {
+		t.Fatalf("expected aesthetic * 100 stored, got %s", expr)
+	}
+
+	err = SetScoring(db, "score", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr := stored("score"); expr != scoringDefault {
+		t.Fatalf("expected the default marker, got %s", expr)
+	}
+
+	expr, err := scoringExpr(db, "score")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr != scoringDefaults["score"] {
+		t.Fatalf("expected the default, got %s", expr)
+	}
+
+	// sqrt only takes integers, fine on the check's sample but not on this thumbnail
+	_, err = db.Exec(`insert into thumbnail (thumbname, facechecked, area, confidence, quality, score)
+		values ('a.webp', 1, 1.5, 0, 0, 0);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetScoring(db, "score", "sqrt(area)")
+	if err == nil {
+		t.Fatal("rescore with a failing expression succeeded")
+	}
+	if expr := stored("score"); expr != scoringDefault {
+		t.Fatalf("expected the default restored, got %s", expr)
+	}
+
+	ceiling, err := AestheticCeiling(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ceiling.Valid || ceiling.Float64 != aestheticWeight {
+		t.Fatalf("expected a ceiling of %f, got %v", aestheticWeight, ceiling)
+	}
+
+	// Probes don't know their sharpness, so no telling how high this goes
+	_, err = db.Exec(`delete from thumbnail;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetScoring(db, "score", "coalesce(aesthetic, 0) + 100 * coalesce(Sharpness, 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ceiling, err = AestheticCeiling(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ceiling.Valid {
+		t.Fatalf("expected no ceiling with sharpness in the expression, got %f", ceiling.Float64)
+	}
+}
+
+// Embeddings survive the trip through a blob, and cosine is 1 for alike, 0 for unrelated
+func TestEmbeddings(t *testing.T) {
+	embedding := []float32{0.5, -0.25, 1, 0}
+	decoded := decodeEmbedding(encodeEmbedding(embedding))
+	if !slices.Equal(decoded, embedding) {
+		t.Fatalf("expected %v, got %v", embedding, decoded)
+	}
+
+	tests := []struct {
+		a, b     []float32
+		expected float64
+	}{
+		{[]float32{1, 2, 3}, []float32{2, 4, 6}, 1},
+		{[]float32{1, 0}, []float32{0, 1}, 0},
+		{[]float32{1, 0}, []float32{-1, 0}, -1},
+		{[]float32{0, 0}, []float32{1, 0}, 0},
+		{[]float32{1, 0}, []float32{1, 0, 0}, 0},
+	}
+	for _, test := range tests {
+		similarity := cosine(test.a, test.b)
+		if math.Abs(similarity-test.expected) > 1e-6 {
+			t.Fatalf("cosine(%v, %v): expected %f, got %f", test.a, test.b, test.expected, similarity)
+		}
+	}
+}
+
+// Alike faces become one person, an unlike one another
+// Naming two people the same merges them, and the person searches follow
+// A file's own person tag is left be, and people go from files whose faces went
+func TestPeople(t *testing.T) {
+	db, pathDir := createTestEnv(t)
+	defer db.Close()
+	defer os.RemoveAll(pathDir)
+
+	_, err := db.Exec(`insert into thumbmap (filename, thumbname)
+		values ('a.mkv', 'a.webp'), ('b.mkv', 'b.webp'), ('c.mkv', 'c.webp');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`insert into tags (filename, name, val) values ('a.mkv', 'person', 'Director');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faces := map[string][]float32{
+		"a.webp": {1, 0, 0},
+		"b.webp": {0.9, 0.1, 0},
+		"c.webp": {0, 1, 0},
+	}
+	for thumbname, embedding := range faces {
+		_, err = db.Exec(`
+			insert into thumbface (thumbname, area, confidence, quality, embedding)
+			values (:thumbname, 10000, 0.9, 0.8, :embedding);`,
+			sql.Named("thumbname", thumbname),
+			sql.Named("embedding", encodeEmbedding(embedding)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := ClusterFaces(db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 faces clustered, got %d", n)
+	}
+
+	personOf := func(thumbname string) int64 {
+		var id int64
+		err := db.QueryRow(`select personid from thumbface where thumbname = :thumbname;`,
+			sql.Named("thumbname", thumbname)).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	if personOf("a.webp") != personOf("b.webp") {
+		t.Fatal("alike faces were made different people")
+	}
+	if personOf("a.webp") == personOf("c.webp") {
+		t.Fatal("unlike faces were made the same person")
+	}
+
+	personTags := func() map[string]string {
+		filenames, names, err := util.AllRows2[string, string](db,
+			`select filename, name from personfile;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tags := make(map[string]string)
+		for i := range filenames {
+			tags[filenames[i]] = names[i]
+		}
+		return tags
+	}
+
+	if tags := personTags(); len(tags) != 0 {
+		t.Fatalf("expected no person tags before naming, got %v", tags)
+	}
+
+	err = NamePerson(db, personOf("a.webp"), "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := personTags()
+	if len(tags) != 2 || tags["a.mkv"] != "Alice" || tags["b.mkv"] != "Alice" {
+		t.Fatalf("expected a.mkv and b.mkv tagged Alice, got %v", tags)
+	}
+
+	err = NamePerson(db, personOf("c.webp"), "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if personOf("a.webp") != personOf("c.webp") {
+		t.Fatal("same name didn't merge people")
+	}
+
+	var count int
+	err = db.QueryRow(`select count(*) from person;`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 person after merging, got %d", count)
+	}
+
+	tags = personTags()
+	if len(tags) != 3 || tags["c.mkv"] != "Alice" {
+		t.Fatalf("expected every file tagged Alice, got %v", tags)
+	}
+
+	// Nothing new to cluster, b.mkv still loses Alice
+	_, err = db.Exec(`delete from thumbface where thumbname = 'b.webp';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ClusterFaces(db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags = personTags()
+	if _, ok := tags["b.mkv"]; ok || len(tags) != 2 {
+		t.Fatalf("expected b.mkv untagged once its face went, got %v", tags)
+	}
+
+	var val string
+	err = db.QueryRow(`select val from tags where filename = 'a.mkv' and name = 'person';`).Scan(&val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "Director" {
+		t.Fatalf("expected a.mkv's own person tag kept, got %s", val)
+	}
+
+	filenames, err := util.AllRows1[string](db,
+		`select filename from searchtags where name = 'person' and val = 'Alice';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 2 {
+		t.Fatalf("expected a person:Alice search to find 2 files, got %v", filenames)
+	}
+}
+
+// Registering a driver twice panics, and every test wants one
+var registerDriver sync.Once
+
 func createTestEnv(t *testing.T) (*sql.DB, string) {
-	sql.Register("sqlite3_custom", &sqlite3.SQLiteDriver{
-		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-			err := conn.RegisterFunc("sqrt", util.MySqrt, true)
-			if err != nil {
-				return err
-			}
-
-			err = conn.RegisterFunc("scorefn", ScoreFunc, true)
-			if err != nil {
-				return err
-			}
-
-			return nil
-		},
+	registerDriver.Do(func() {
+		sql.Register("sqlite3_custom", &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				err := conn.RegisterFunc("sqrt", util.MySqrt, true)
+				if err != nil {
+					return err
+				}
+
+				err = conn.RegisterFunc("scorefn", ScoreFunc, true)
+				if err != nil {
+					return err
+				}
+
+				return nil
+			},
+		})
 	})
 
 	db, err := sql.Open("sqlite3_custom", ":memory:")
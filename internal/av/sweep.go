@@ -0,0 +1,166 @@
+//Sweeps
+// The other way of finding better thumbnails, instead of the Improver's one probe per file per loop
+// Thirty frames of a file are scored in one pass over it, the best few kept as thumbnails
+// Gets there in one go, where the Improver takes up to thirty trips round the database
+
+package av
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+// Frames looked at per file, the same as the Improver gives up at
+const sweepProbes = 30
+
+// Best frames kept as thumbnails, the evaluator and ThumbCull sort them out from there
+const sweepKeep = 3
+
+// Sweeps the files the Improver would otherwise work on, each only once
+func (e *Evaluator) Sweep(db *sql.DB) (int, error) {
+	count := 0
+
+	threshold, err := ScoreThreshold(db)
+	if err != nil {
+		log.Println(err)
+		return count, err
+	}
+
+	filenames, err := util.AllRows1[string](db, `
+		select filename
+		from mediastat
+		where facechecked
+		and canseek
+		and not pinned
+		and not swept
+		and bestscore < :threshold
+		order by probes asc;`, sql.Named("threshold", threshold))
+	if err != nil {
+		log.Println(err)
+		return count, err
+	}
+
+	for _, filename := range filenames {
+		err = e.sweep(db, filename)
+		if err != nil {
+			return count, err
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+// A file that won't probe is marked swept all the same, the Improver isn't going to do better
+func (e *Evaluator) sweep(db *sql.DB, filename string) error {
+	var probes []avc.Probe
+	set, err := e.tmb.Probe(filename, sweepProbes)
+	if err != nil {
+		log.Printf("%s: %s", filename, err)
+	} else {
+		defer set.Close()
+		probes = set.Probes()
+	}
+
+	scores, err := probeScores(db, probes)
+	if err != nil {
+		return err
+	}
+
+	order := make([]int, len(probes))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, i := range order[:min(sweepKeep, len(order))] {
+		b, err := set.Image(i)
+		if err != nil {
+			log.Printf("%s: %s", filename, err)
+			continue
+		}
+
+		digest, err := Checksum(b)
+		if err != nil {
+			return err
+		}
+
+		err = insertThumbnail(tx, e.store, filename, Thumbnail{
+			source: filename,
+			digest: digest,
+			image:  b,
+			pos:    sql.NullFloat64{Float64: probes[i].Pos, Valid: true},
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	// facechecked = 0 gets the evaluator onto the new thumbnails
+	_, err = tx.Exec(`
+		update mediastat set
+			swept = 1,
+			probes = probes + :probes,
+			facechecked = 0
+		where filename = :filename;`,
+		sql.Named("filename", filename),
+		sql.Named("probes", len(probes)))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Probes are scored with the stored score expression, the same as thumbnails are
+// Only the aesthetic is known, the rest of the image quality columns are null like an unassessed thumbnail's
+func probeScores(db *sql.DB, probes []avc.Probe) ([]float64, error) {
+	expr, err := scoringExpr(db, "score")
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		select coalesce((%s), 0)
+		from (
+			select
+				:area as area,
+				:confidence as confidence,
+				:quality as quality,
+				null as sharpness,
+				null as exposure,
+				null as colourfulness,
+				:aesthetic as aesthetic,
+				:pos as pos
+		);`, expr)
+
+	scores := make([]float64, len(probes))
+	for i, p := range probes {
+		err = db.QueryRow(query,
+			sql.Named("area", p.Area),
+			sql.Named("confidence", p.Confidence),
+			sql.Named("quality", p.Quality),
+			sql.Named("aesthetic", p.Aesthetic),
+			sql.Named("pos", p.Pos)).Scan(&scores[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return scores, nil
+}
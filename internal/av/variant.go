@@ -0,0 +1,296 @@
+//Thumbnail size variants
+// Thumbnails are stored 540 pixels high, other sizes are made in the background (MakeVariants) and cached
+// Smaller ones are scaled down from the stored thumbnail
+// Bigger ones go back to the source frame, scaling a 540 up would just be blurry
+// Crops to other shapes are taken from a size variant, around the faces in it or its focus point
+// Serving only ever reads the cache, see CachedVariant
+
+package av
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
+	"github.com/jml-89/http-server-av/internal/util"
+)
+
+// Heights that can be asked for, anything else gets the stored thumbnail
+var ThumbSizes = []int{180, 360, 720, 1080}
+
+const thumbHeight = 540
+
+// Shapes thumbnails can be cropped to, width / height
+var ThumbCrops = map[string]float64{
+	"1:1":  1,
+	"4:5":  4.0 / 5,
+	"9:16": 9.0 / 16,
+}
+
+// Returns thumbname at the requested height, making it first if need be
+// Variants are kept in the store as <size>/<thumbname>
+func ThumbVariant(db *sql.DB, store thumbstore.ThumbStore, thumbname string, size int) ([]byte, error) {
+	thumbname = path.Base(thumbname)
+	if !slices.Contains(ThumbSizes, size) {
+		return store.Get(thumbname)
+	}
+
+	name := variantName(thumbname, size, "")
+	b, err := store.Get(name)
+	if err == nil {
+		return b, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	done := false
+	if size > thumbHeight {
+		b, err = variantFromSource(db, thumbname, size)
+		if err == nil {
+			done = true
+		} else if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("%s: falling back to scaling thumbnail: %s", thumbname, err)
+		}
+	}
+
+	if !done {
+		b, err = variantFromThumb(store, thumbname, size)
+		// Builds without libav can't scale, the stored size will have to do
+		if errors.Is(err, errors.ErrUnsupported) {
+			return store.Get(thumbname)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = store.Put(name, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Returns thumbname cropped to one of ThumbCrops at the requested height
+// Crops are kept in the store as <crop>/<size>/<thumbname>, with the colon of crop as an x
+// An unknown crop gets the thumbnail uncropped
+func ThumbCrop(db *sql.DB, store thumbstore.ThumbStore, thumbname string, size int, crop string) ([]byte, error) {
+	aspect, ok := ThumbCrops[crop]
+	if !ok {
+		return ThumbVariant(db, store, thumbname, size)
+	}
+
+	thumbname = path.Base(thumbname)
+	height := size
+	if !slices.Contains(ThumbSizes, size) {
+		height = thumbHeight
+	}
+
+	name := variantName(thumbname, height, crop)
+	b, err := store.Get(name)
+	if err == nil {
+		return b, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	b, err = ThumbVariant(db, store, thumbname, size)
+	if err != nil {
+		return nil, err
+	}
+
+	focus, err := cropFocus(db, thumbname)
+	if err != nil {
+		return nil, err
+	}
+
+	cropped, err := avc.CropImageBufFocus(b, focus, aspect, height)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return nil, err
+	}
+	// Built without OpenCV, uncropped is the best on offer and is kept as the crop
+	if err == nil {
+		b = cropped
+	}
+
+	err = store.Put(name, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// A variant that's been made already, for serving
+// Sizes and crops there's no variant directory for don't exist
+// Ones not made yet get the stored thumbnail until MakeVariants gets to them
+func CachedVariant(store thumbstore.ThumbStore, thumbname string, size int, crop string) ([]byte, error) {
+	thumbname = path.Base(thumbname)
+	if size == 0 && crop == "" {
+		return store.Get(thumbname)
+	}
+
+	if crop != "" && size == 0 {
+		size = thumbHeight
+	}
+
+	name := variantName(thumbname, size, crop)
+	if !slices.Contains(variantDirs(), path.Dir(name)) {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+
+	b, err := store.Get(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store.Get(thumbname)
+	}
+	return b, err
+}
+
+// Makes every size and crop of up to limit thumbnails which haven't had them made yet
+// Thumbnails that fail are logged and marked all the same, they'd only fail again
+func MakeVariants(db *sql.DB, store thumbstore.ThumbStore, limit int) (int, error) {
+	count := 0
+
+	thumbnames, err := util.AllRows1[string](db, `
+		select thumbname
+		from thumbnail
+		where not variants
+		limit :limit;`, sql.Named("limit", limit))
+	if err != nil {
+		return count, err
+	}
+
+	heights := append([]int{thumbHeight}, ThumbSizes...)
+	for _, thumbname := range thumbnames {
+		for _, size := range ThumbSizes {
+			_, err = ThumbVariant(db, store, thumbname, size)
+			if err != nil {
+				log.Printf("%s: failed to make %d variant: %s", thumbname, size, err)
+			}
+		}
+
+		for crop := range ThumbCrops {
+			for _, height := range heights {
+				_, err = ThumbCrop(db, store, thumbname, height, crop)
+				if err != nil {
+					log.Printf("%s: failed to make %s %d variant: %s", thumbname, crop, height, err)
+				}
+			}
+		}
+
+		_, err = db.Exec(`update thumbnail set variants = 1 where thumbname = :thumbname;`,
+			sql.Named("thumbname", thumbname))
+		if err != nil {
+			return count, err
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+// Where a variant is kept, <size>/<thumbname> or <crop>/<size>/<thumbname>
+func variantName(thumbname string, size int, crop string) string {
+	if crop == "" {
+		return path.Join(strconv.Itoa(size), thumbname)
+	}
+	return path.Join(cropDir(crop), strconv.Itoa(size), thumbname)
+}
+
+// Every directory variants are kept in, gc looks for strays in these
+func variantDirs() []string {
+	dirs := []string{"."}
+	for _, size := range ThumbSizes {
+		dirs = append(dirs, strconv.Itoa(size))
+	}
+
+	heights := append([]int{thumbHeight}, ThumbSizes...)
+	for crop := range ThumbCrops {
+		for _, height := range heights {
+			dirs = append(dirs, path.Join(cropDir(crop), strconv.Itoa(height)))
+		}
+	}
+
+	return dirs
+}
+
+func cropDir(crop string) string {
+	return strings.Replace(crop, ":", "x", 1)
+}
+
+// Where a crop should be centred, in fractions of the thumbnail
+// The middle of the faces, bigger faces counting for more
+// Failing that wherever the assessment found most eye-catching, failing that the middle
+func cropFocus(db *sql.DB, thumbname string) (avc.Point, error) {
+	var x, y sql.NullFloat64
+	err := db.QueryRow(`
+		select
+			sum((box_x + box_w / 2) * box_w * box_h) / sum(box_w * box_h),
+			sum((box_y + box_h / 2) * box_w * box_h) / sum(box_w * box_h)
+		from thumbface
+		where thumbname = :thumbname
+		and box_x is not null
+		and box_w * box_h > 0;`,
+		sql.Named("thumbname", thumbname)).Scan(&x, &y)
+	if err != nil {
+		return avc.Point{}, err
+	}
+
+	if !x.Valid || !y.Valid {
+		err = db.QueryRow(`select focus_x, focus_y from thumbnail where thumbname = :thumbname;`,
+			sql.Named("thumbname", thumbname)).Scan(&x, &y)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return avc.Point{}, err
+		}
+	}
+
+	if !x.Valid || !y.Valid {
+		return avc.Point{X: 0.5, Y: 0.5}, nil
+	}
+
+	return avc.Point{X: float32(x.Float64), Y: float32(y.Float64)}, nil
+}
+
+// Takes the thumbnail's frame again, straight from the media file
+func variantFromSource(db *sql.DB, thumbname string, size int) ([]byte, error) {
+	var filename string
+	var pos float64
+	err := db.QueryRow(`
+		select a.filename, b.pos
+		from thumbmap a
+		inner join thumbnail b
+		on a.thumbname = b.thumbname
+		where a.thumbname = :thumbname
+		and b.pos is not null
+		limit 1;`,
+		sql.Named("thumbname", thumbname)).Scan(&filename, &pos)
+	if err != nil {
+		return nil, err
+	}
+
+	// pos is 0 for the first frame of files that wouldn't seek
+	return avc.CreateThumbnailSized(filename, pos > 0, pos, size)
+}
+
+// Scales the stored thumbnail
+func variantFromThumb(store thumbstore.ThumbStore, thumbname string, size int) ([]byte, error) {
+	b, err := store.Get(thumbname)
+	if err != nil {
+		return nil, err
+	}
+
+	return avc.CreateThumbnailSizedReader(bytes.NewReader(b), false, 0, size)
+}
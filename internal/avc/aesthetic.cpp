@@ -0,0 +1,144 @@
+//go:build !noopencv
+
+#include "aesthetic.hpp"
+
+#include <cmath>
+#include <algorithm>
+
+#include <opencv2/imgproc.hpp>
+
+#include "util.hpp"
+
+// Variance of the Laplacian, the usual cheap blur measure
+// Blurry frames (motion, transitions, out of focus) sit well under 100
+// Anything from a few hundred up is sharp enough
+static float measure_sharpness(const cv::Mat& grey) {
+	cv::Mat lap;
+	cv::Laplacian(grey, lap, CV_64F);
+
+	cv::Scalar mean, stddev;
+	cv::meanStdDev(lap, mean, stddev);
+
+	auto variance = stddev[0] * stddev[0];
+	return static_cast<float>(1.0 - std::exp(-variance / 200.0));
+}
+
+// Mid-grey average with few clipped pixels is best
+static float measure_exposure(const cv::Mat& grey) {
+	auto mean = cv::mean(grey)[0];
+
+	auto clipped = cv::countNonZero(grey < 16) + cv::countNonZero(grey > 239);
+	auto clipped_frac = static_cast<double>(clipped) / static_cast<double>(grey.total());
+
+	auto centred = std::max(0.0, 1.0 - std::abs(mean - 118.0) / 118.0);
+	return static_cast<float>(centred * (1.0 - clipped_frac));
+}
+
+// Hasler and Suesstrunk colourfulness
+// Around 100 is "extremely colourful", so that's taken as the top
+static float measure_colourfulness(const cv::Mat& image) {
+	cv::Mat bgr[3];
+	cv::Mat image_f;
+	image.convertTo(image_f, CV_32F);
+	cv::split(image_f, bgr);
+
+	cv::Mat rg = bgr[2] - bgr[1];
+	cv::Mat yb = 0.5 * (bgr[2] + bgr[1]) - bgr[0];
+
+	cv::Scalar mean_rg, sd_rg, mean_yb, sd_yb;
+	cv::meanStdDev(rg, mean_rg, sd_rg);
+	cv::meanStdDev(yb, mean_yb, sd_yb);
+
+	auto sd = std::sqrt(sd_rg[0] * sd_rg[0] + sd_yb[0] * sd_yb[0]);
+	auto mu = std::sqrt(mean_rg[0] * mean_rg[0] + mean_yb[0] * mean_yb[0]);
+
+	return static_cast<float>(std::min(1.0, (sd + 0.3 * mu) / 100.0));
+}
+
+// Spectral residual saliency (Hou and Zhang), what's left once the usual spectrum is taken away
+// Small is plenty, only the rough location is wanted
+static cv::Point2f measure_focus(const cv::Mat& grey) {
+	const int side = 64;
+	auto centre = cv::Point2f(0.5f, 0.5f);
+
+	cv::Mat small;
+	cv::resize(grey, small, cv::Size(side, side), 0, 0, cv::INTER_AREA);
+	small.convertTo(small, CV_32F);
+
+	cv::Mat planes[] = {small, cv::Mat::zeros(small.size(), CV_32F)};
+	cv::Mat spectrum;
+	cv::merge(planes, 2, spectrum);
+	cv::dft(spectrum, spectrum);
+	cv::split(spectrum, planes);
+
+	cv::Mat magnitude, phase;
+	cv::cartToPolar(planes[0], planes[1], magnitude, phase);
+
+	cv::Mat log_magnitude, smoothed;
+	cv::log(magnitude + 1e-6f, log_magnitude);
+	cv::blur(log_magnitude, smoothed, cv::Size(3, 3));
+
+	cv::Mat residual;
+	cv::exp(log_magnitude - smoothed, residual);
+	cv::polarToCart(residual, phase, planes[0], planes[1]);
+	cv::merge(planes, 2, spectrum);
+	cv::dft(spectrum, spectrum, cv::DFT_INVERSE | cv::DFT_SCALE);
+	cv::split(spectrum, planes);
+
+	cv::Mat saliency;
+	cv::magnitude(planes[0], planes[1], saliency);
+	saliency = saliency.mul(saliency);
+	cv::GaussianBlur(saliency, saliency, cv::Size(9, 9), 2.5);
+
+	// Only the strongest part counts, otherwise everything averages out to the middle
+	double max_val = 0.0;
+	cv::minMaxLoc(saliency, nullptr, &max_val);
+	if (max_val <= 0.0) {
+		return centre;
+	}
+	saliency.setTo(0.0f, saliency < 0.5 * max_val);
+
+	auto m = cv::moments(saliency);
+	if (m.m00 <= 0.0) {
+		return centre;
+	}
+
+	return cv::Point2f(
+		static_cast<float>((m.m10 / m.m00 + 0.5) / side),
+		static_cast<float>((m.m01 / m.m00 + 0.5) / side)
+	);
+}
+
+assessment assess_aesthetic(const cv::Mat& image_in) {
+	auto results = assessment{0, 0.0f, 0.0f, 0.0f, 0.0f, 0.5f, 0.5f};
+	if (image_in.empty()) {
+		return results;
+	}
+	results.valid = 1;
+
+	// Same size as a stored thumbnail, so Laplacian numbers are comparable between images
+	auto image = image_scale(image_in, 960, 540);
+
+	cv::Mat grey;
+	cv::cvtColor(image, grey, cv::COLOR_BGR2GRAY);
+
+	results.sharpness = measure_sharpness(grey);
+	results.exposure = measure_exposure(grey);
+	results.colourfulness = measure_colourfulness(image);
+
+	auto focus = measure_focus(grey);
+	results.focus_x = focus.x;
+	results.focus_y = focus.y;
+
+	// Black and near-black frames (fades, title cards) are worth nothing however they measure
+	auto dark_frac = static_cast<double>(cv::countNonZero(grey < 24)) / static_cast<double>(grey.total());
+	if (dark_frac > 0.9) {
+		return results;
+	}
+
+	// Sharpness counts most, a blurry frame is a bad thumbnail however well lit
+	results.aesthetic = results.sharpness * (0.6f * results.exposure + 0.4f * results.colourfulness);
+	results.aesthetic *= static_cast<float>(1.0 - dark_frac);
+
+	return results;
+}
@@ -0,0 +1,20 @@
+#pragma once
+
+#include <opencv2/core.hpp>
+
+// Technical quality of an image, all 0.0 to 1.0
+// Faces aren't considered at all, this is for everything else
+struct assessment {
+	int valid;
+	float sharpness;
+	float exposure;
+	float colourfulness;
+	float aesthetic;
+
+	// Centre of whatever stands out most, fractions of the image
+	// Crops of frames without faces go around it
+	float focus_x;
+	float focus_y;
+};
+
+assessment assess_aesthetic(const cv::Mat& image);
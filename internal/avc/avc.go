@@ -1,3 +1,5 @@
+//go:build !ffmpegcli
+
 // This was an experiment
 // Instead of the usual approach of writing a simple wrapper
 // Write functions that program needs that call C API directly
@@ -27,7 +29,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"sync"
 	"unsafe"
 
 	"encoding/hex"
@@ -35,25 +39,29 @@ import (
 )
 
 var errNotMediaFile = errors.New("File is not an image or video")
-var errSeekFailed = errors.New("Seek failed")
+var ErrSeekFailed = errors.New("Seek failed")
 
 // Some files could be the same video with different metadata
 // A checksum of the video stream should answer the duplicate question
 // Does not decode, just demuxes and digests raw packet data
 func MediaChecksum(path string) (string, error) {
-	pathInArg := C.CString(path)
-	defer C.free(unsafe.Pointer(pathInArg))
+	return mediaChecksum(source{path: path})
+}
+
+func MediaChecksumReader(r io.ReadSeeker) (string, error) {
+	return mediaChecksum(source{r: r})
+}
 
-	var ctxFmtIn *C.AVFormatContext = nil
-	err := avop(C.avformat_open_input(&ctxFmtIn, pathInArg, nil, nil))
+func mediaChecksum(src source) (string, error) {
+	ctxFmtIn, closeIn, err := src.open()
 	if err != nil {
 		return "", err
 	}
-	defer C.avformat_close_input(&ctxFmtIn)
+	defer closeIn()
 
 	err = avop(C.avformat_find_stream_info(ctxFmtIn, nil))
 	if err != nil {
-		log.Printf("%s: %s\n", path, err)
+		log.Printf("%s: %s\n", src, err)
 		return "", err
 	}
 
@@ -75,7 +83,7 @@ func MediaChecksum(path string) (string, error) {
 		err = avop(C.av_read_frame(ctxFmtIn, pktDec))
 		if err != nil {
 			if err.Error() != "End of file" {
-				log.Printf("%s: %s\n", path, err)
+				log.Printf("%s: %s\n", src, err)
 			}
 			break
 		}
@@ -133,17 +141,21 @@ func FileChecksum(path string) (string, error) {
 }
 
 func GetMetadata(path string) (map[string]string, error) {
-	res := make(map[string]string)
+	return getMetadata(source{path: path})
+}
 
-	cpath := C.CString(path)
-	defer C.free(unsafe.Pointer(cpath))
+func GetMetadataReader(r io.ReadSeeker) (map[string]string, error) {
+	return getMetadata(source{r: r})
+}
 
-	var avctx *C.AVFormatContext = nil
-	err := avop(C.avformat_open_input(&avctx, cpath, nil, nil))
+func getMetadata(src source) (map[string]string, error) {
+	res := make(map[string]string)
+
+	avctx, closeIn, err := src.open()
 	if err != nil {
 		return res, err
 	}
-	defer C.avformat_close_input(&avctx)
+	defer closeIn()
 
 	blank := C.CString("")
 	defer C.free(unsafe.Pointer(blank))
@@ -185,7 +197,7 @@ func GetMetadata(path string) (map[string]string, error) {
 	return res, nil
 }
 
-func CreateEncoderWEBP(width, height int, pathOut string) (*C.AVFormatContext, *C.AVCodecContext, error) {
+func CreateEncoderWEBP(width, height int) (*C.AVFormatContext, *C.AVCodecContext, error) {
 	var octx *C.AVFormatContext = nil
 	var ectx *C.AVCodecContext = nil
 
@@ -244,9 +256,7 @@ func CreateEncoderWEBP(width, height int, pathOut string) (*C.AVFormatContext, *
 		return nil, nil, err
 	}
 
-	pathTmp := C.CString(pathOut)
-	defer C.free(unsafe.Pointer(pathTmp))
-	err = avop(C.avio_open(&octx.pb, pathTmp, C.AVIO_FLAG_WRITE))
+	err = avop(C.avio_open_dyn_buf(&octx.pb))
 	if err != nil {
 		C.avcodec_free_context(&ectx)
 		C.avformat_free_context(octx)
@@ -255,6 +265,7 @@ func CreateEncoderWEBP(width, height int, pathOut string) (*C.AVFormatContext, *
 
 	err = avop(C.avformat_write_header(octx, nil))
 	if err != nil {
+		freeOutput(octx)
 		C.avcodec_free_context(&ectx)
 		C.avformat_free_context(octx)
 		return nil, nil, err
@@ -263,6 +274,53 @@ func CreateEncoderWEBP(width, height int, pathOut string) (*C.AVFormatContext, *
 	return octx, ectx, nil
 }
 
+// Encodes a single frame and writes it out as the whole WEBP
+// Flushes the encoder and writes the trailer, so the output is complete after this
+func writeFrameWEBP(ctxFmtOut *C.AVFormatContext, ctxEnc *C.AVCodecContext, frame *C.AVFrame) error {
+	pktEnc := C.av_packet_alloc()
+	defer C.av_packet_free(&pktEnc)
+
+	err := avop(C.avcodec_send_frame(ctxEnc, frame))
+	if err != nil {
+		return err
+	}
+
+	err = avop(C.avcodec_send_frame(ctxEnc, nil))
+	if err != nil {
+		return err
+	}
+
+	err = avop(C.avcodec_receive_packet(ctxEnc, pktEnc))
+	if err != nil {
+		return err
+	}
+	defer C.av_packet_unref(pktEnc)
+
+	err = avop(C.av_write_frame(ctxFmtOut, pktEnc))
+	if err != nil {
+		return err
+	}
+
+	return avop(C.av_write_trailer(ctxFmtOut))
+}
+
+// Encoders write to a dynamic buffer rather than a file, takeOutput hands it over to Go
+// pb is closed and freed after, so it can only be taken once
+func takeOutput(ctxFmtOut *C.AVFormatContext) []byte {
+	var buf *C.uint8_t
+	n := C.avio_close_dyn_buf(ctxFmtOut.pb, &buf)
+	ctxFmtOut.pb = nil
+	defer C.av_free(unsafe.Pointer(buf))
+	return C.GoBytes(unsafe.Pointer(buf), n)
+}
+
+// For the error paths, avio_closep can't be used on a dynamic buffer
+func freeOutput(ctxFmtOut *C.AVFormatContext) {
+	if ctxFmtOut.pb != nil {
+		takeOutput(ctxFmtOut)
+	}
+}
+
 // Adds a filter to a graph and (somewhat) hides the C string management issue
 func createFilter(id, filter, args string, graph *C.AVFilterGraph) (*C.AVFilterContext, error) {
 	filterC := C.CString(filter)
@@ -318,34 +376,107 @@ func InitFiltersTestImage(imgW, imgH int) (*C.AVFilterGraph, *C.AVFilterContext,
 	return graph, ctxSnk, nil
 }
 
-func InitFiltersScaling(ctxEnc, ctxDec *C.AVCodecContext) (*C.AVFilterGraph, *C.AVFilterContext, *C.AVFilterContext, error) {
+// Clockwise degrees to turn a stream upright, 0, 90, 180 or 270
+func streamRotation(stream *C.AVStream) int {
+	theta := -float64(C.stream_rotation(stream))
+	if math.IsNaN(theta) {
+		return 0
+	}
+	return (int(math.Round(theta/90))%4 + 4) % 4 * 90
+}
+
+// Shape of a stream's pixels, DVDs store 720 wide whatever the picture's shape
+// The container gets a say over the codec, same as ffmpeg
+func streamSAR(stream *C.AVStream, ctxDec *C.AVCodecContext) C.AVRational {
+	sar := stream.sample_aspect_ratio
+	if sar.num <= 0 || sar.den <= 0 {
+		sar = ctxDec.sample_aspect_ratio
+	}
+	if sar.num <= 0 || sar.den <= 0 {
+		sar.num = 1
+		sar.den = 1
+	}
+	return sar
+}
+
+// Width at height for a stream as it's meant to be seen, turned upright with square pixels
+func displayWidth(stream *C.AVStream, ctxDec *C.AVCodecContext, height int) int {
+	sar := streamSAR(stream, ctxDec)
+	w := float64(ctxDec.width) * float64(sar.num) / float64(sar.den)
+	h := float64(ctxDec.height)
+	if streamRotation(stream)%180 != 0 {
+		w, h = h, w
+	}
+	return int(w * float64(height) / h)
+}
+
+// One filter in a chain, e.g. {"scale", "h=540:w=960"}
+type filterSpec struct {
+	filter string
+	args   string
+}
+
+func InitFiltersScaling(ctxEnc, ctxDec *C.AVCodecContext, stream *C.AVStream, deinterlace bool) (*C.AVFilterGraph, *C.AVFilterContext, *C.AVFilterContext, error) {
+	return InitFiltersScalingTo(ctxDec, stream, int(ctxEnc.width), int(ctxEnc.height), ctxEnc.pix_fmt, deinterlace)
+}
+
+// Same as InitFiltersScaling, for when the output isn't going straight into an encoder
+// Frames are turned upright first, then scaled to exactly width x height with square pixels
+// width should come from displayWidth, or the picture gets stretched
+//
+// deinterlace is only for stills, bwdif holds an interlaced frame back until the next one comes
+// Push the frame then flush the source with a nil frame to get it out
+// Sprites and previews skip around the video, there's no next frame worth waiting for
+func InitFiltersScalingTo(ctxDec *C.AVCodecContext, stream *C.AVStream, width, height int, pixFmt C.enum_AVPixelFormat, deinterlace bool) (*C.AVFilterGraph, *C.AVFilterContext, *C.AVFilterContext, error) {
+	sar := streamSAR(stream, ctxDec)
+	chain := scalingChain(ctxDec, stream, width, height, deinterlace)
+
 	graph := C.avfilter_graph_alloc()
 	ctxSrc, err := createFilter(
 		"in",
 		"buffer",
-		fmt.Sprintf("video_size=%dx%d:pix_fmt=%d:time_base=30001/1:pixel_aspect=1/1",
-			ctxDec.width, ctxDec.height, ctxDec.pix_fmt),
+		fmt.Sprintf("video_size=%dx%d:pix_fmt=%d:time_base=30001/1:pixel_aspect=%d/%d",
+			ctxDec.width, ctxDec.height, ctxDec.pix_fmt, sar.num, sar.den),
 		graph)
+	if err != nil {
+		log.Printf("%s\n", err)
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
 	ctxSnk, err := createFilter(
 		"out",
 		"buffersink",
 		"",
 		graph)
-	ctxScale, err := createFilter(
-		"scale",
-		"scale",
-		fmt.Sprintf("h=%d:w=-1", ctxEnc.height),
-		graph)
-
-	err = avop(C.avfilter_link(ctxSrc, 0, ctxScale, 0))
 	if err != nil {
 		log.Printf("%s\n", err)
+		C.avfilter_graph_free(&graph)
 		return nil, nil, nil, err
 	}
 
-	err = avop(C.avfilter_link(ctxScale, 0, ctxSnk, 0))
+	prev := ctxSrc
+	for i, f := range chain {
+		ctx, err := createFilter(fmt.Sprintf("%s%d", f.filter, i), f.filter, f.args, graph)
+		if err != nil {
+			log.Printf("%s\n", err)
+			C.avfilter_graph_free(&graph)
+			return nil, nil, nil, err
+		}
+
+		err = avop(C.avfilter_link(prev, 0, ctx, 0))
+		if err != nil {
+			log.Printf("%s\n", err)
+			C.avfilter_graph_free(&graph)
+			return nil, nil, nil, err
+		}
+		prev = ctx
+	}
+
+	err = avop(C.avfilter_link(prev, 0, ctxSnk, 0))
 	if err != nil {
 		log.Printf("%s\n", err)
+		C.avfilter_graph_free(&graph)
 		return nil, nil, nil, err
 	}
 
@@ -354,22 +485,120 @@ func InitFiltersScaling(ctxEnc, ctxDec *C.AVCodecContext) (*C.AVFilterGraph, *C.
 
 	err = avop(C.av_opt_set_bin(
 		unsafe.Pointer(ctxSnk), argFmts,
-		(*C.uint8_t)(unsafe.Pointer(&ctxEnc.pix_fmt)), C.sizeof_int,
+		(*C.uint8_t)(unsafe.Pointer(&pixFmt)), C.sizeof_int,
 		C.AV_OPT_SEARCH_CHILDREN))
 	if err != nil {
 		log.Println(err)
+		C.avfilter_graph_free(&graph)
 		return nil, nil, nil, err
 	}
 
 	err = avop(C.avfilter_graph_config(graph, nil))
 	if err != nil {
 		log.Println(err)
+		C.avfilter_graph_free(&graph)
 		return nil, nil, nil, err
 	}
 
 	return graph, ctxSrc, ctxSnk, nil
 }
 
+// Fields go first while the lines are still in their original order
+// Tone mapping goes after the resize, 4K in 32 bit float is slow going
+// Whatever comes in, out comes 601 limited range, which is what WEBP decoders assume
+func scalingChain(ctxDec *C.AVCodecContext, stream *C.AVStream, width, height int, deinterlace bool) []filterSpec {
+	chain := []filterSpec{}
+
+	if deinterlace && ctxDec.field_order != C.AV_FIELD_PROGRESSIVE {
+		// Progressive frames in a stream that doesn't say go straight through
+		chain = append(chain, filterSpec{"bwdif", "mode=send_frame:deint=interlaced"})
+	}
+
+	switch streamRotation(stream) {
+	case 90:
+		chain = append(chain, filterSpec{"transpose", "clock"})
+	case 180:
+		chain = append(chain, filterSpec{"hflip", ""}, filterSpec{"vflip", ""})
+	case 270:
+		chain = append(chain, filterSpec{"transpose", "cclock"})
+	}
+
+	inMatrix, inRange := colorMatrix(ctxDec), colorRange(ctxDec)
+	if isHDR(ctxDec) {
+		if hasFilter("zscale") {
+			// zscale takes the transfer and primaries from the frames
+			chain = append(chain,
+				filterSpec{"zscale", fmt.Sprintf("w=%d:h=%d:t=linear:npl=100", width, height)},
+				filterSpec{"format", "gbrpf32le"},
+				filterSpec{"zscale", "p=bt709"},
+				filterSpec{"tonemap", "tonemap=hable:desat=0"},
+				filterSpec{"zscale", "t=bt709:m=bt709:r=tv"},
+				filterSpec{"format", "yuv420p"})
+			inMatrix, inRange = "bt709", "tv"
+		} else {
+			warnNoZscale.Do(func() {
+				log.Println("HDR video but no zscale filter in this libavfilter, thumbnails won't be tone mapped")
+			})
+		}
+	}
+
+	return append(chain,
+		filterSpec{"scale", fmt.Sprintf("h=%d:w=%d:in_color_matrix=%s:in_range=%s:out_color_matrix=bt601:out_range=tv",
+			height, width, inMatrix, inRange)},
+		filterSpec{"setsar", "1"})
+}
+
+var warnNoZscale sync.Once
+
+func hasFilter(name string) bool {
+	nameC := C.CString(name)
+	defer C.free(unsafe.Pointer(nameC))
+	return C.avfilter_get_by_name(nameC) != nil
+}
+
+// PQ is HDR10 and Dolby Vision's base layer, HLG is broadcast HDR
+func isHDR(ctxDec *C.AVCodecContext) bool {
+	return ctxDec.color_trc == C.AVCOL_TRC_SMPTE2084 || ctxDec.color_trc == C.AVCOL_TRC_ARIB_STD_B67
+}
+
+// swscale's name for the stream's YUV matrix
+// Unlabelled video is guessed at by size like players do, HD is 709 and SD is 601
+func colorMatrix(ctxDec *C.AVCodecContext) string {
+	switch ctxDec.colorspace {
+	case C.AVCOL_SPC_BT709:
+		return "bt709"
+	case C.AVCOL_SPC_BT470BG, C.AVCOL_SPC_SMPTE170M:
+		return "bt601"
+	case C.AVCOL_SPC_SMPTE240M:
+		return "smpte240m"
+	case C.AVCOL_SPC_FCC:
+		return "fcc"
+	case C.AVCOL_SPC_BT2020_NCL, C.AVCOL_SPC_BT2020_CL:
+		return "bt2020"
+	}
+
+	if ctxDec.height >= 720 {
+		return "bt709"
+	}
+	return "bt601"
+}
+
+// Video is limited range unless it says otherwise, JPEGs and the yuvj formats are full
+func colorRange(ctxDec *C.AVCodecContext) string {
+	switch ctxDec.color_range {
+	case C.AVCOL_RANGE_JPEG:
+		return "pc"
+	case C.AVCOL_RANGE_MPEG:
+		return "tv"
+	}
+
+	switch ctxDec.pix_fmt {
+	case C.AV_PIX_FMT_YUVJ420P, C.AV_PIX_FMT_YUVJ422P, C.AV_PIX_FMT_YUVJ444P, C.AV_PIX_FMT_YUVJ440P:
+		return "pc"
+	}
+	return "tv"
+}
+
 func OpenBestStream(ctxFmt *C.AVFormatContext, avtype int32) (C.uint, *C.AVCodecContext, error) {
 	var decoder *C.AVCodec = nil
 	is := C.av_find_best_stream(ctxFmt, avtype, -1, -1, &decoder, 0)
@@ -394,26 +623,148 @@ func OpenBestStream(ctxFmt *C.AVFormatContext, avtype int32) (C.uint, *C.AVCodec
 	return idxStream, ctxDec, nil
 }
 
+// Duration in seconds, fractions included, 0 or less if it's not known
+func durationSeconds(ctxFmtIn *C.AVFormatContext) float64 {
+	return float64(ctxFmtIn.duration) / float64(C.AV_TIME_BASE)
+}
+
+// Stream timestamp for seconds in
+// Player time starts at zero, stream timestamps don't have to
+func streamTimestamp(stream *C.AVStream, seconds float64) C.int64_t {
+	ts := C.int64_t(seconds / float64(C.av_q2d(stream.time_base)))
+	if C.has_timestamp(stream.start_time) != 0 {
+		ts += stream.start_time
+	}
+	return ts
+}
+
+// Seconds in for a stream timestamp, the other way round
+func streamSeconds(stream *C.AVStream, ts C.int64_t) float64 {
+	if C.has_timestamp(stream.start_time) != 0 {
+		ts -= stream.start_time
+	}
+	return float64(ts) * float64(C.av_q2d(stream.time_base))
+}
+
+// Seeks stream idxStream to pos, a 0.0 to 1.0 fraction of the duration
+// Lands on whichever keyframe the demuxer likes, quick but rough, fine for sprites and previews
+func seekFraction(ctxFmtIn *C.AVFormatContext, idxStream C.uint, pos float64) error {
+	seconds := max(durationSeconds(ctxFmtIn), 0) * pos
+	ts := streamTimestamp(C.get_nth_stream(ctxFmtIn, idxStream), seconds)
+	err := avop(C.av_seek_frame(ctxFmtIn, C.int(idxStream), ts, 0))
+	if err != nil {
+		return ErrSeekFailed
+	}
+
+	return nil
+}
+
+// Decodes stream idxStream up to seconds in, frame ends up as the first frame at or past it
+// Seeks to the keyframe before and decodes forward, so it can take a moment on long GOPs
+// Running off the end gives the last frame there was
+// Returns where the frame really is, in seconds
+func seekAccurate(ctxFmtIn *C.AVFormatContext, ctxDec *C.AVCodecContext, idxStream C.uint, seconds float64, pktDec *C.AVPacket, frame *C.AVFrame) (float64, error) {
+	stream := C.get_nth_stream(ctxFmtIn, idxStream)
+	target := streamTimestamp(stream, seconds)
+
+	err := avop(C.av_seek_frame(ctxFmtIn, C.int(idxStream), target, C.AVSEEK_FLAG_BACKWARD))
+	if err != nil {
+		return 0, ErrSeekFailed
+	}
+	C.avcodec_flush_buffers(ctxDec)
+
+	framePrev := C.av_frame_alloc()
+	defer C.av_frame_free(&framePrev)
+
+	for true {
+		err = decodeNextFrame(ctxFmtIn, ctxDec, idxStream, pktDec, frame)
+		if err != nil {
+			if err.Error() == "End of file" {
+				if framePrev.data[0] != nil {
+					C.av_frame_move_ref(frame, framePrev)
+					break
+				}
+				// Nothing decoded between the seek and the end, the seek may as well have failed
+				return 0, fmt.Errorf("%w: %s", ErrSeekFailed, err)
+			}
+			return 0, err
+		}
+
+		ts := frame.best_effort_timestamp
+		if C.has_timestamp(ts) == 0 || ts >= target {
+			break
+		}
+
+		C.av_frame_unref(framePrev)
+		C.av_frame_move_ref(framePrev, frame)
+	}
+
+	if ts := frame.best_effort_timestamp; C.has_timestamp(ts) != 0 {
+		return streamSeconds(stream, ts), nil
+	}
+	return seconds, nil
+}
+
+// Reads and decodes until the next frame of stream idxStream comes out
+// frame is unref'd first, so the same one can be passed in over and over
+// Flushes the decoder at end of file, the last error out is "End of file"
+func decodeNextFrame(ctxFmtIn *C.AVFormatContext, ctxDec *C.AVCodecContext, idxStream C.uint, pktDec *C.AVPacket, frame *C.AVFrame) error {
+	C.av_frame_unref(frame)
+
+	for true {
+		rc := C.avcodec_receive_frame(ctxDec, frame)
+		if rc != -C.EAGAIN {
+			return avop(rc)
+		}
+
+		err := avop(C.av_read_frame(ctxFmtIn, pktDec))
+		if err != nil {
+			if err.Error() != "End of file" {
+				return err
+			}
+
+			err = avop(C.avcodec_send_packet(ctxDec, nil))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if pktDec.stream_index != C.int(idxStream) {
+			C.av_packet_unref(pktDec)
+			continue
+		}
+
+		err = avop(C.avcodec_send_packet(ctxDec, pktDec))
+		C.av_packet_unref(pktDec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Just creates a 960x540 test image
 // Wanted to do a spectrum picture for audio files, but the filter consumed a lot of memory
-// So this is the fallback
-func CreateGenericThumbnail(pathOut string) error {
+// Audio gets a waveform now (CreateWaveformThumbnail), this is the fallback for when even that fails
+func CreateGenericThumbnail() ([]byte, error) {
 	imgH := 540
 	imgW := 960
 
-	ctxFmtOut, ctxEnc, err := CreateEncoderWEBP(imgW, imgH, pathOut)
+	ctxFmtOut, ctxEnc, err := CreateEncoderWEBP(imgW, imgH)
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 	defer C.avformat_free_context(ctxFmtOut)
 	defer C.avcodec_free_context(&ctxEnc)
-	defer C.avio_closep(&ctxFmtOut.pb)
+	defer freeOutput(ctxFmtOut)
 
 	graph, ctxSnk, err := InitFiltersTestImage(imgW, imgH)
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 	defer C.avfilter_graph_free(&graph)
 
@@ -426,31 +777,31 @@ func CreateGenericThumbnail(pathOut string) error {
 	err = avop(C.av_buffersink_get_frame(ctxSnk, frameFiltered))
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 
 	err = avop(C.avcodec_send_frame(ctxEnc, frameFiltered))
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 
 	err = avop(C.avcodec_send_frame(ctxEnc, nil))
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 
 	err = avop(C.avcodec_receive_packet(ctxEnc, pktEnc))
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 
 	err = avop(C.av_write_frame(ctxFmtOut, pktEnc))
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 
 	C.av_frame_unref(frameFiltered)
@@ -459,15 +810,14 @@ func CreateGenericThumbnail(pathOut string) error {
 	err = avop(C.av_write_trailer(ctxFmtOut))
 	if err != nil {
 		log.Printf("%s", err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	return takeOutput(ctxFmtOut), nil
 }
 
 // Creates a 960x540 WEBP thumbnail
 // pathIn: video filepath
-// pathOut: thumbnail filepath
 // seek: try to seek?
 // pos: if seeking, go to this position; pos range is 0.0 to 1.0, describing a percentage position in the video
 //
@@ -475,164 +825,147 @@ func CreateGenericThumbnail(pathOut string) error {
 //
 // Each time this function is called, a WEBP encoder is created
 // One could consider hoisting that call out and passing it as a parameter
-func CreateThumbnailX(pathIn, pathOut string, seek bool, pos float64) error {
-	var ctxFmtIn *C.AVFormatContext = nil
-	pathInArg := C.CString(pathIn)
-	defer C.free(unsafe.Pointer(pathInArg))
+func CreateThumbnailX(pathIn string, seek bool, pos float64) ([]byte, error) {
+	return CreateThumbnailSized(pathIn, seek, pos, 540)
+}
+
+// Same again with the media read from r, nothing has to be on disk (see avio.go)
+func CreateThumbnailXReader(r io.ReadSeeker, seek bool, pos float64) ([]byte, error) {
+	return CreateThumbnailSizedReader(r, seek, pos, 540)
+}
 
-	err := avop(C.avformat_open_input(&ctxFmtIn, pathInArg, nil, nil))
+// CreateThumbnailX with a choice of height, width follows the aspect ratio
+// Also works on images, thumbnails included, so it doubles as a resizer
+func CreateThumbnailSized(pathIn string, seek bool, pos float64, imgH int) ([]byte, error) {
+	b, _, err := createThumbnail(source{path: pathIn}, atFraction(seek, pos), imgH)
+	return b, err
+}
+
+func CreateThumbnailSizedReader(r io.ReadSeeker, seek bool, pos float64, imgH int) ([]byte, error) {
+	b, _, err := createThumbnail(source{r: r}, atFraction(seek, pos), imgH)
+	return b, err
+}
+
+// Picks the time to take a frame at once the duration is known
+type position func(durationSeconds float64) (float64, error)
+
+// Files that don't know their duration go to the start, seeking there still says whether they can
+// nil without seek, the first keyframe is taken as it comes
+func atFraction(seek bool, pos float64) position {
+	if !seek {
+		return nil
+	}
+	return func(durationSeconds float64) (float64, error) {
+		return max(durationSeconds, 0) * pos, nil
+	}
+}
+
+// Takes the frame showing at a position, or the first keyframe if at is nil
+// Returns the frame's real position as a fraction of the duration, which can be a little past the one asked for
+func createThumbnail(src source, at position, imgH int) ([]byte, float64, error) {
+	ctxFmtIn, closeIn, err := src.open()
 	if err != nil {
 		// if it fails here, it's because the file wasn't a media file
-		return err
+		return nil, 0, err
 	}
-	defer C.avformat_close_input(&ctxFmtIn)
+	defer closeIn()
 
 	err = avop(C.avformat_find_stream_info(ctxFmtIn, nil))
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 
 	idxStream, ctxDec, err := OpenBestStream(ctxFmtIn, C.AVMEDIA_TYPE_VIDEO)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer C.avcodec_free_context(&ctxDec)
 
-	imgH := 540
-	ratio := float64(imgH) / float64(ctxDec.height)
-	imgW := int(float64(ctxDec.width) * ratio)
+	stream := C.get_nth_stream(ctxFmtIn, idxStream)
+	imgW := displayWidth(stream, ctxDec, imgH)
 
-	ctxFmtOut, ctxEnc, err := CreateEncoderWEBP(imgW, imgH, pathOut)
+	ctxFmtOut, ctxEnc, err := CreateEncoderWEBP(imgW, imgH)
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 	defer C.avformat_free_context(ctxFmtOut)
 	defer C.avcodec_free_context(&ctxEnc)
-	defer C.avio_closep(&ctxFmtOut.pb)
+	defer freeOutput(ctxFmtOut)
 
-	graph, ctxSrc, ctxSnk, err := InitFiltersScaling(ctxEnc, ctxDec)
+	graph, ctxSrc, ctxSnk, err := InitFiltersScaling(ctxEnc, ctxDec, stream, true)
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 	defer C.avfilter_graph_free(&graph)
 
-	if seek {
-		durationSeconds := ctxFmtIn.duration / C.AV_TIME_BASE
-		var midPos C.AVRational
-		midPos.num = C.int(float64(durationSeconds) * pos)
-		midPos.den = 1
-
-		rts := C.av_mul_q(midPos, C.av_inv_q(C.get_nth_stream(ctxFmtIn, idxStream).time_base))
-		timestamp := C.av_q2d(rts)
-		err = avop(C.av_seek_frame(ctxFmtIn, C.int(idxStream), C.long(timestamp), 0))
-		if err != nil {
-			return errSeekFailed
-		}
-	}
-
 	pktDec := C.av_packet_alloc()
 	defer C.av_packet_free(&pktDec)
 
-	pktEnc := C.av_packet_alloc()
-	defer C.av_packet_free(&pktEnc)
-
 	frame := C.av_frame_alloc()
 	defer C.av_frame_free(&frame)
 
 	frameFiltered := C.av_frame_alloc()
 	defer C.av_frame_free(&frameFiltered)
 
-	for true {
-		err = avop(C.av_read_frame(ctxFmtIn, pktDec))
+	pos := 0.0
+	if at != nil {
+		duration := durationSeconds(ctxFmtIn)
+		seconds, err := at(duration)
 		if err != nil {
-			log.Printf("%s: %s\n", pathIn, err)
-			return err
+			return nil, 0, err
 		}
-		defer C.av_packet_unref(pktDec)
 
-		if pktDec.stream_index != C.int(idxStream) {
-			continue
-		}
-
-		err = avop(C.avcodec_send_packet(ctxDec, pktDec))
+		shown, err := seekAccurate(ctxFmtIn, ctxDec, idxStream, seconds, pktDec, frame)
 		if err != nil {
-			log.Printf("%s: %s\n", pathIn, err)
-			return err
-		}
-
-		rc := C.avcodec_receive_frame(ctxDec, frame)
-		// should be C.AVERROR(C.EAGAIN) but doesn't work
-		// AVERROR definition in error.h is
-		// #define AVERROR(e) (-(e))
-		// so just negative of EAGAIN to check
-		if rc == -C.EAGAIN {
-			continue
+			return nil, 0, err
 		}
-		if rc < 0 {
-			log.Printf("%s: %s\n", pathIn, err)
-			return errors.New("Failed to decode frame")
-		}
-		defer C.av_frame_unref(frame)
 
-		if frame.pict_type != C.AV_PICTURE_TYPE_I {
-			continue
+		if duration > 0 {
+			pos = min(max(shown/duration, 0), 1)
 		}
+	} else {
+		for true {
+			err = decodeNextFrame(ctxFmtIn, ctxDec, idxStream, pktDec, frame)
+			if err != nil {
+				log.Printf("%s: %s\n", src, err)
+				return nil, 0, err
+			}
 
-		err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, frame, 0))
-		if err != nil {
-			log.Printf("%s: %s\n", pathIn, err)
-			return err
+			if frame.pict_type == C.AV_PICTURE_TYPE_I {
+				break
+			}
 		}
-
-		break
-	}
-
-	err = avop(C.av_buffersink_get_frame(ctxSnk, frameFiltered))
-	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
 	}
 
-	err = avop(C.avcodec_send_frame(ctxEnc, frameFiltered))
-	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
-	}
-
-	err = avop(C.avcodec_send_frame(ctxEnc, nil))
+	err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, frame, 0))
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 
-	err = avop(C.avcodec_receive_packet(ctxEnc, pktEnc))
+	// Lets the deinterlacer go of the frame it's holding back
+	err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, nil, 0))
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 
-	err = avop(C.av_write_frame(ctxFmtOut, pktEnc))
+	err = avop(C.av_buffersink_get_frame(ctxSnk, frameFiltered))
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 
-	C.av_frame_unref(frameFiltered)
-	C.av_packet_unref(pktEnc)
-
-	C.av_frame_unref(frame)
-	C.av_packet_unref(pktDec)
-
-	err = avop(C.av_write_trailer(ctxFmtOut))
+	err = writeFrameWEBP(ctxFmtOut, ctxEnc, frameFiltered)
 	if err != nil {
-		log.Printf("%s: %s\n", pathIn, err)
-		return err
+		log.Printf("%s: %s\n", src, err)
+		return nil, 0, err
 	}
 
-	return nil
+	return takeOutput(ctxFmtOut), pos, nil
 }
 
 func avop(rc C.int) error {
@@ -0,0 +1,164 @@
+//go:build !ffmpegcli
+
+//Custom IO
+// Media read through callbacks instead of from a path, so it can come out of archives, memory, anywhere
+// libav calls back into Go for every read and seek, the reader is found again through a cgo.Handle
+// An io.ReaderAt works too, io.NewSectionReader makes it into an io.ReadSeeker
+
+package avc
+
+/*
+#include <errno.h>
+#include <stdlib.h>
+#include <libavformat/avformat.h>
+
+extern int avcRead(void *opaque, uint8_t *buf, int size);
+extern int64_t avcSeek(void *opaque, int64_t offset, int whence);
+*/
+import "C"
+
+import (
+	"errors"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+const avioBufSize = 64 * 1024
+
+// AVERROR_EOF is FFERRTAG('E', 'O', 'F', ' ')
+const averrorEOF = -C.int('E' | 'O'<<8 | 'F'<<16 | ' '<<24)
+
+// Where media comes from, a path unless there's a reader
+type source struct {
+	path string
+	r    io.ReadSeeker
+}
+
+func (src source) String() string {
+	if src.r != nil {
+		return "reader"
+	}
+	return src.path
+}
+
+// Opens the input for demuxing, close frees everything open allocated
+// On error there's nothing to close
+func (src source) open() (*C.AVFormatContext, func(), error) {
+	if src.r != nil {
+		return openReader(src.r)
+	}
+
+	cpath := C.CString(src.path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	var ctxFmt *C.AVFormatContext = nil
+	err := avop(C.avformat_open_input(&ctxFmt, cpath, nil, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ctxFmt, func() { C.avformat_close_input(&ctxFmt) }, nil
+}
+
+// The handle lives in C memory, libav keeps hold of opaque and Go pointers aren't allowed to stay in C
+func openReader(r io.ReadSeeker) (*C.AVFormatContext, func(), error) {
+	h := cgo.NewHandle(r)
+	opaque := (*cgo.Handle)(C.malloc(C.size_t(unsafe.Sizeof(h))))
+	*opaque = h
+
+	freeHandle := func() {
+		h.Delete()
+		C.free(unsafe.Pointer(opaque))
+	}
+
+	buf := C.av_malloc(avioBufSize)
+	if buf == nil {
+		freeHandle()
+		return nil, nil, errors.New("Failed to allocate IO buffer")
+	}
+
+	ctxIO := C.avio_alloc_context((*C.uchar)(buf), avioBufSize, 0, unsafe.Pointer(opaque),
+		(*[0]byte)(C.avcRead), nil, (*[0]byte)(C.avcSeek))
+	if ctxIO == nil {
+		C.av_free(buf)
+		freeHandle()
+		return nil, nil, errors.New("Failed to create IO context")
+	}
+
+	// libav may swap the buffer for a bigger one, so it's freed through ctxIO
+	freeIO := func() {
+		C.av_freep(unsafe.Pointer(&ctxIO.buffer))
+		C.avio_context_free(&ctxIO)
+		freeHandle()
+	}
+
+	ctxFmt := C.avformat_alloc_context()
+	if ctxFmt == nil {
+		freeIO()
+		return nil, nil, errors.New("Failed to create format context")
+	}
+	ctxFmt.pb = ctxIO
+
+	// Frees ctxFmt itself on failure, custom IO is left alone
+	err := avop(C.avformat_open_input(&ctxFmt, nil, nil, nil))
+	if err != nil {
+		freeIO()
+		return nil, nil, err
+	}
+
+	return ctxFmt, func() {
+		C.avformat_close_input(&ctxFmt)
+		freeIO()
+	}, nil
+}
+
+func readerOf(opaque unsafe.Pointer) io.ReadSeeker {
+	return (*(*cgo.Handle)(opaque)).Value().(io.ReadSeeker)
+}
+
+//export avcRead
+func avcRead(opaque unsafe.Pointer, buf *C.uint8_t, size C.int) C.int {
+	b := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))
+	n, err := io.ReadFull(readerOf(opaque), b)
+	if n > 0 {
+		return C.int(n)
+	}
+	if errors.Is(err, io.EOF) {
+		return averrorEOF
+	}
+	return -C.EIO
+}
+
+// whence is SEEK_SET, SEEK_CUR or SEEK_END, same numbers as io's
+// AVSEEK_SIZE asks for the size without moving, AVSEEK_FORCE can be ignored
+//
+//export avcSeek
+func avcSeek(opaque unsafe.Pointer, offset C.int64_t, whence C.int) C.int64_t {
+	r := readerOf(opaque)
+
+	if whence&C.AVSEEK_SIZE != 0 {
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -C.EIO
+		}
+
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -C.EIO
+		}
+
+		_, err = r.Seek(cur, io.SeekStart)
+		if err != nil {
+			return -C.EIO
+		}
+
+		return C.int64_t(size)
+	}
+
+	pos, err := r.Seek(int64(offset), int(whence&^C.AVSEEK_FORCE))
+	if err != nil {
+		return -C.EIO
+	}
+	return C.int64_t(pos)
+}
@@ -0,0 +1,54 @@
+//go:build !ffmpegcli
+
+package avc
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Everything here stays in memory, the test image is encoded by avc itself
+func TestReader(t *testing.T) {
+	b, err := CreateGenericThumbnail()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := GetMetadataReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["mediatype"] != "image" {
+		t.Errorf("mediatype is %q, want image", metadata["mediatype"])
+	}
+
+	thumb, err := CreateThumbnailSizedReader(bytes.NewReader(b), false, 0, 180)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumb) == 0 || bytes.Equal(thumb, b) {
+		t.Error("expected a new, smaller thumbnail")
+	}
+
+	// A ReaderAt by way of a SectionReader has to come out the same
+	sum1, err := MediaChecksumReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum2, err := MediaChecksumReader(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sum1 != sum2 {
+		t.Errorf("checksums differ, %s and %s", sum1, sum2)
+	}
+
+	_, err = GetMetadataReader(strings.NewReader("this is not a media file"))
+	if err == nil {
+		t.Error("expected an error reading a text file")
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !ffmpegcli
+
+// Thumbnails at an exact time
+// For when someone has paused on the frame they want, or a chapter starts somewhere in particular
+
+package avc
+
+import (
+	"errors"
+	"io"
+)
+
+// Creates a WEBP thumbnail of the frame showing at seconds into the video
+// pathIn: video filepath
+// Returns the position of the frame as a fraction of the duration, like CreateThumbnailX takes
+//
+// The time based way in, CreateThumbnailX takes a fraction instead, both land on the same frames
+func CreateThumbnailAt(pathIn string, seconds float64) ([]byte, float64, error) {
+	return createThumbnail(source{path: pathIn}, atSeconds(seconds), 540)
+}
+
+func CreateThumbnailAtReader(r io.ReadSeeker, seconds float64) ([]byte, float64, error) {
+	return createThumbnail(source{r: r}, atSeconds(seconds), 540)
+}
+
+// Unlike a fraction, a time means nothing without a duration to check it against
+func atSeconds(seconds float64) position {
+	return func(durationSeconds float64) (float64, error) {
+		if durationSeconds <= 0 {
+			return 0, errors.New("Unknown duration")
+		}
+		if seconds < 0 || seconds > durationSeconds {
+			return 0, errors.New("Time is outside the video")
+		}
+		return seconds, nil
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !noopencv
+
+#include "classify.hpp"
+
+#include <algorithm>
+#include <cmath>
+#include <numeric>
+
+#include <opencv2/imgproc.hpp>
+
+#include "util.hpp"
+
+// No model leaves net empty, nothing is classified
+classifier::classifier(const std::vector<unsigned char>& model) {
+	if (!model.empty()) {
+		net = cv::dnn::readNetFromONNX(model);
+	}
+}
+
+// Returns a probability per label
+// Models ending in a softmax are taken as they are, raw logits get one
+std::vector<float> classifier::classify(const cv::Mat& image) {
+	if (net.empty() || image.empty()) {
+		return {};
+	}
+
+	// Centre square, classifiers are trained on those
+	auto side = std::min(image.cols, image.rows);
+	auto centre = image(cv::Rect((image.cols - side) / 2, (image.rows - side) / 2, side, side));
+
+	cv::Mat image_rgb;
+	cv::cvtColor(centre, image_rgb, cv::COLOR_BGR2RGB);
+	cv::resize(image_rgb, image_rgb, cv::Size(width, height), 0, 0, cv::INTER_AREA);
+
+	std::vector<cv::Mat> channels;
+	cv::split(image_rgb, channels);
+	for (int i = 0; i < 3; i++) {
+		channels[i].convertTo(
+			channels[i],
+			CV_32FC1,
+			1.0 / (255.0 * std_devs[i]),
+			(0.0 - means[i]) / std_devs[i]
+		);
+	}
+	cv::Mat normalised;
+	cv::merge(channels, normalised);
+
+	net.setInput(cv::dnn::blobFromImage(normalised));
+	auto output = net.forward();
+
+	auto p = reinterpret_cast<float*>(output.data);
+	std::vector<float> scores(p, p + output.total());
+	if (scores.empty()) {
+		return scores;
+	}
+
+	auto sum = std::accumulate(scores.begin(), scores.end(), 0.f);
+	auto [lo, hi] = std::ranges::minmax(scores);
+	if (lo < 0.f || hi > 1.f || std::abs(sum - 1.f) > 0.01f) {
+		return softmax(scores);
+	}
+	return scores;
+}
@@ -0,0 +1,23 @@
+#pragma once
+
+#include <vector>
+
+#include <opencv2/core.hpp>
+#include <opencv2/dnn.hpp>
+
+// A general image classifier (ImageNet-style, 224x224 in, one score per label out)
+// What's in the frame rather than who
+class classifier {
+public:
+	classifier() = default;
+	classifier(const std::vector<unsigned char>& model);
+	std::vector<float> classify(const cv::Mat& image);
+
+private:
+	const int width = 224;
+	const int height = 224;
+	cv::dnn::Net net;
+
+	const std::vector<float> means = { 0.485, 0.456, 0.406 };
+	const std::vector<float> std_devs = { 0.229, 0.224, 0.225 };
+};
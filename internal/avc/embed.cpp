@@ -0,0 +1,52 @@
+//go:build !noopencv
+
+#include "embed.hpp"
+
+#include <cmath>
+
+#include <opencv2/imgproc.hpp>
+
+// No model leaves net empty, and every embedding empty with it
+face_embedder::face_embedder(const std::vector<unsigned char>& model) {
+	if (!model.empty()) {
+		net = cv::dnn::readNetFromONNX(model);
+	}
+}
+
+// Faces aren't aligned with the landmarks first
+// It costs some accuracy, but the clustering threshold is forgiving enough
+std::vector<float> face_embedder::embed(const cv::Mat& image_face) {
+	if (net.empty() || image_face.empty()) {
+		return {};
+	}
+
+	// (x - 127.5) / 127.5, the usual ArcFace input
+	auto blob = cv::dnn::blobFromImage(
+		image_face,
+		1/127.5, // scalefactor
+		cv::Size(width, height),
+		cv::Scalar(127.5, 127.5, 127.5), // mean
+		true, // swapRB
+		false // crop
+	);
+	net.setInput(blob);
+
+	auto output = net.forward();
+	auto p = reinterpret_cast<float*>(output.data);
+	auto length = static_cast<int>(output.total());
+
+	std::vector<float> embedding(p, p + length);
+
+	float norm = 0.f;
+	for (auto x : embedding) {
+		norm += x * x;
+	}
+	norm = std::sqrt(norm);
+	if (norm > 0.f) {
+		for (auto& x : embedding) {
+			x /= norm;
+		}
+	}
+
+	return embedding;
+}
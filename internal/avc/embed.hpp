@@ -0,0 +1,20 @@
+#pragma once
+
+#include <vector>
+
+#include <opencv2/core.hpp>
+#include <opencv2/dnn.hpp>
+
+// Turns a face crop into a vector where the same person lands close together
+// Output is L2 normalised, so a dot product is the cosine similarity
+class face_embedder {
+public:
+	face_embedder() = default;
+	face_embedder(const std::vector<unsigned char>& model);
+	std::vector<float> embed(const cv::Mat& image_face);
+
+private:
+	const int width = 112;
+	const int height = 112;
+	cv::dnn::Net net;
+};
@@ -0,0 +1,41 @@
+//go:build ffmpegcli
+
+//No libav
+// Stands in for the libav code in builds tagged ffmpegcli, see media.CLI for what's left
+// Thumbnails, metadata and the test pattern come from the ffmpeg commands instead
+// The rest is unsupported: audio gets the test pattern, no previews or sprite sheets, probing goes back to random positions
+
+package avc
+
+import (
+	"errors"
+	"io"
+)
+
+func CreateWaveformThumbnail(pathIn string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func CreateAnimatedPreview(pathIn string, clips int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func CreateSpriteSheet(pathIn string, interval float64) ([]byte, SpriteSheet, error) {
+	return nil, SpriteSheet{}, errors.ErrUnsupported
+}
+
+func SceneCandidates(pathIn string, num int) ([]Candidate, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func CreateThumbnailAt(pathIn string, seconds float64) ([]byte, float64, error) {
+	return nil, 0, errors.ErrUnsupported
+}
+
+func CreateThumbnailSized(pathIn string, seek bool, pos float64, imgH int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func CreateThumbnailSizedReader(r io.ReadSeeker, seek bool, pos float64, imgH int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -2,6 +2,7 @@
 
 // Just going to have these guys defined in the header file
 // If it was a larger file, then, well
+// They're static so more than one cgo file in the package can include this
 
 #include <stdio.h>
 #include <stdlib.h>
@@ -13,10 +14,12 @@
 #include <libavutil/dict.h>
 #include <libavutil/pixdesc.h>
 #include <libavutil/opt.h>
+#include <libavutil/channel_layout.h>
+#include <libavutil/display.h>
 #include <libavfilter/buffersink.h>
 #include <libavfilter/buffersrc.h>
 
-int get_pix_fmt(enum AVPixelFormat* fmts, enum AVPixelFormat hope) {
+static int get_pix_fmt(enum AVPixelFormat* fmts, enum AVPixelFormat hope) {
 	for (int i = 0; fmts[i] != -1; i++) {
 	if (fmts[i] == hope) {
 			return i;
@@ -25,7 +28,42 @@ int get_pix_fmt(enum AVPixelFormat* fmts, enum AVPixelFormat hope) {
 	return -1;
 }
 
-AVStream *get_nth_stream(AVFormatContext *fmt_ctx, uint i) {
+static AVStream *get_nth_stream(AVFormatContext *fmt_ctx, uint i) {
 	return fmt_ctx->streams[i];
 }
 
+// abuffer wants the channel layout as a string
+// Some decoders leave the layout unspecified, give those the default for the channel count
+static int describe_ch_layout(AVCodecContext *ctx, char *buf, size_t len) {
+	if (ctx->ch_layout.order == AV_CHANNEL_ORDER_UNSPEC) {
+		int n = ctx->ch_layout.nb_channels;
+		av_channel_layout_uninit(&ctx->ch_layout);
+		av_channel_layout_default(&ctx->ch_layout, n);
+	}
+	return av_channel_layout_describe(&ctx->ch_layout, buf, len);
+}
+
+// AV_NOPTS_VALUE is a bit much for cgo to digest
+static int has_timestamp(int64_t ts) {
+	return ts != AV_NOPTS_VALUE;
+}
+
+// The display matrix's rotation in degrees, counterclockwise like av_display_rotation_get, 0 without one
+// Stream side data moved into codecpar in libavcodec 60.29
+static double stream_rotation(AVStream *st) {
+	const int32_t *matrix = NULL;
+#if LIBAVCODEC_VERSION_INT >= AV_VERSION_INT(60, 29, 100)
+	const AVPacketSideData *sd = av_packet_side_data_get(
+		st->codecpar->coded_side_data, st->codecpar->nb_coded_side_data,
+		AV_PKT_DATA_DISPLAYMATRIX);
+	if (sd) {
+		matrix = (const int32_t *)sd->data;
+	}
+#else
+	matrix = (const int32_t *)av_stream_get_side_data(st, AV_PKT_DATA_DISPLAYMATRIX, NULL);
+#endif
+	if (!matrix) {
+		return 0;
+	}
+	return av_display_rotation_get(matrix);
+}
@@ -0,0 +1,132 @@
+//go:build !noopencv
+
+//Models for the thumbnailer
+// Face finding and quality are built in by default, either can be swapped for one on disk without a rebuild
+// The face embedder and tagger only come from disk, without them there are no people or autotags
+// Each model set gets a version, so results from older models can be found and redone
+
+package avc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+import _ "embed"
+
+//go:embed weights/face-quality-assessment.onnx
+var netAssess []byte
+
+//go:embed weights/yolov8n-face.onnx
+var netDetect []byte
+
+type model struct {
+	data   []byte
+	digest string
+}
+
+type modelSet struct {
+	detect model
+	assess model
+	embed  model
+	tag    model
+	labels []string
+
+	labelsDigest string
+}
+
+// Everything is handed to OpenCV in memory, built in models never touch the disk
+func loadModels(cfg ThumbnailerConfig) (modelSet, error) {
+	var models modelSet
+	var err error
+
+	loads := []struct {
+		dst     *model
+		path    string
+		builtin []byte
+	}{
+		{&models.detect, cfg.DetectModel, netDetect},
+		{&models.assess, cfg.AssessModel, netAssess},
+		{&models.embed, cfg.EmbedModel, nil},
+		{&models.tag, cfg.TagModel, nil},
+	}
+
+	for _, load := range loads {
+		*load.dst, err = loadModel(load.path, load.builtin)
+		if err != nil {
+			return models, err
+		}
+	}
+
+	// Labels are meaningless without their model and the other way round
+	if (cfg.TagModel == "") != (cfg.TagLabels == "") {
+		return models, errors.New("A tagger needs both a model and its labels")
+	}
+
+	if cfg.TagLabels != "" {
+		labels, err := os.ReadFile(cfg.TagLabels)
+		if err != nil {
+			return models, err
+		}
+		models.labels = parseLabels(string(labels))
+		models.labelsDigest = digest(labels)
+	}
+
+	return models, nil
+}
+
+// A model that isn't built in and wasn't given is left empty, digest and all
+func loadModel(path string, builtin []byte) (model, error) {
+	b := builtin
+	if path != "" {
+		var err error
+		b, err = os.ReadFile(path)
+		if err != nil {
+			return model{}, err
+		}
+	}
+	if len(b) == 0 {
+		return model{}, nil
+	}
+	return model{data: b, digest: digest(b)}, nil
+}
+
+// Bumped when Face gains something worth going back for
+// 2: landmarks
+const faceFormat = 2
+
+func (models modelSet) faceVersion(cfg ThumbnailerConfig) string {
+	return digest([]byte(fmt.Sprintf("%d %s %s %s %g %g", faceFormat,
+		models.detect.digest, models.assess.digest, models.embed.digest,
+		cfg.FaceConfidence, cfg.FaceNMS)))
+}
+
+// Empty without a tagger, like the embedder's
+func (models modelSet) tagVersion(cfg ThumbnailerConfig) string {
+	if models.tag.digest == "" {
+		return ""
+	}
+	return digest([]byte(fmt.Sprintf("%s %s %g",
+		models.tag.digest, models.labelsDigest, cfg.TagConfidence)))
+}
+
+// Short, it only has to tell model sets apart
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6])
+}
+
+// ImageNet label files often list synonyms, "tabby, tabby cat", only the first is kept
+func parseLabels(file string) []string {
+	lines := strings.Split(strings.TrimSpace(file), "\n")
+	labels := make([]string, len(lines))
+	for i, line := range lines {
+		name, _, _ := strings.Cut(line, ",")
+		labels[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	return labels
+}
@@ -0,0 +1,76 @@
+//go:build noopencv
+
+//No OpenCV
+// Stands in for thumbwrap.go in builds tagged noopencv
+// Nothing has faces or labels, every image rates the same, so thumbnails are still checked and scored
+// Just not usefully, the first thumbnail of a file is as good as any
+
+package avc
+
+import (
+	"errors"
+)
+
+const OpenCV = false
+
+type nullThumbnailer struct{}
+
+func NewThumbnailer(cfg ThumbnailerConfig) (Thumbnailer, error) {
+	return nullThumbnailer{}, nil
+}
+
+// A build with OpenCV sees this as out of date and checks for faces again
+func (t nullThumbnailer) FaceVersion() string {
+	return "noopencv"
+}
+
+// No models, so nothing to group people or autotag with
+func (t nullThumbnailer) EmbedVersion() string {
+	return ""
+}
+
+func (t nullThumbnailer) TagVersion() string {
+	return ""
+}
+
+func (t nullThumbnailer) RunImageBuf(image []byte) ([]Face, error) {
+	return []Face{}, nil
+}
+
+func (t nullThumbnailer) RunImagesBuf(images [][]byte) ([][]Face, error) {
+	faces := make([][]Face, len(images))
+	for i := range faces {
+		faces[i] = []Face{}
+	}
+	return faces, nil
+}
+
+func (t nullThumbnailer) ClassifyImageBuf(image []byte) ([]Label, error) {
+	return []Label{}, nil
+}
+
+func (t nullThumbnailer) Probe(pathVideo string, probes int) (ProbeSet, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (t nullThumbnailer) Close() {
+}
+
+// Middling marks for everything, and the middle of the image
+func AssessImageBuf(image []byte) (Aesthetic, error) {
+	return Aesthetic{
+		Sharpness:     0.5,
+		Exposure:      0.5,
+		Colourfulness: 0.5,
+		Aesthetic:     0.5,
+		Focus:         Point{X: 0.5, Y: 0.5},
+	}, nil
+}
+
+func CropImageBuf(image []byte, box Box, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func CropImageBufFocus(image []byte, focus Point, aspect float64, height int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
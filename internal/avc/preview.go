@@ -0,0 +1,286 @@
+//go:build !ffmpegcli
+
+// Animated previews
+// A handful of short clips from through the video, stitched into one looping WEBP
+
+package avc
+
+/*
+#include "helpers.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"log"
+	"math"
+	"unsafe"
+)
+
+// Plays back at previewFps, each clip is framesPerClip frames taken clipStride seconds apart
+// So each clip is about a second of video at a reduced frame rate
+const previewFps = 5
+const framesPerClip = 5
+const clipStride = 0.2
+
+// Like CreateEncoderWEBP but for animations
+// Frames are timed in 1/fps units and the result loops forever
+func CreateEncoderWEBPAnim(width, height, fps int) (*C.AVFormatContext, *C.AVCodecContext, error) {
+	var octx *C.AVFormatContext = nil
+	var ectx *C.AVCodecContext = nil
+
+	cfmt := C.CString("webp")
+	defer C.free(unsafe.Pointer(cfmt))
+
+	err := avop(C.avformat_alloc_output_context2(&octx, nil, cfmt, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	os := C.avformat_new_stream(octx, nil)
+	if os == nil {
+		C.avformat_free_context(octx)
+		return nil, nil, errors.New("Failed to create stream")
+	}
+
+	// Plain AV_CODEC_ID_WEBP lookup might hand back the single image encoder
+	encName := C.CString("libwebp_anim")
+	defer C.free(unsafe.Pointer(encName))
+
+	enc := C.avcodec_find_encoder_by_name(encName)
+	if enc == nil {
+		C.avformat_free_context(octx)
+		return nil, nil, errors.New("Failed to find animated WEBP encoder!")
+	}
+
+	ectx = C.avcodec_alloc_context3(enc)
+	if ectx == nil {
+		C.avformat_free_context(octx)
+		return nil, nil, errors.New("Failed to create encoder context")
+	}
+
+	ectx.width = (C.int)(width)
+	ectx.height = (C.int)(height)
+	ectx.pix_fmt = C.AV_PIX_FMT_YUV420P
+
+	ectx.time_base.num = 1
+	ectx.time_base.den = C.int(fps)
+	os.time_base = ectx.time_base
+
+	// Previews are small and there are a lot of them, trade some quality for size
+	var encOpts *C.AVDictionary = nil
+	defer C.av_dict_free(&encOpts)
+	optKey := C.CString("quality")
+	defer C.free(unsafe.Pointer(optKey))
+	optVal := C.CString("60")
+	defer C.free(unsafe.Pointer(optVal))
+	C.av_dict_set(&encOpts, optKey, optVal, 0)
+
+	err = avop(C.avcodec_open2(ectx, enc, &encOpts))
+	if err != nil {
+		C.avcodec_free_context(&ectx)
+		C.avformat_free_context(octx)
+		return nil, nil, err
+	}
+
+	err = avop(C.avcodec_parameters_from_context(os.codecpar, ectx))
+	if err != nil {
+		C.avcodec_free_context(&ectx)
+		C.avformat_free_context(octx)
+		return nil, nil, err
+	}
+
+	err = avop(C.avio_open_dyn_buf(&octx.pb))
+	if err != nil {
+		C.avcodec_free_context(&ectx)
+		C.avformat_free_context(octx)
+		return nil, nil, err
+	}
+
+	var muxOpts *C.AVDictionary = nil
+	defer C.av_dict_free(&muxOpts)
+	loopKey := C.CString("loop")
+	defer C.free(unsafe.Pointer(loopKey))
+	loopVal := C.CString("0")
+	defer C.free(unsafe.Pointer(loopVal))
+	C.av_dict_set(&muxOpts, loopKey, loopVal, 0)
+
+	err = avop(C.avformat_write_header(octx, &muxOpts))
+	if err != nil {
+		freeOutput(octx)
+		C.avcodec_free_context(&ectx)
+		C.avformat_free_context(octx)
+		return nil, nil, err
+	}
+
+	return octx, ectx, nil
+}
+
+// Takes whatever packets the encoder has ready and muxes them
+func writePackets(ctxFmtOut *C.AVFormatContext, ctxEnc *C.AVCodecContext, pktEnc *C.AVPacket) error {
+	for true {
+		rc := C.avcodec_receive_packet(ctxEnc, pktEnc)
+		if rc == -C.EAGAIN {
+			return nil
+		}
+		err := avop(rc)
+		if err != nil {
+			if err.Error() == "End of file" {
+				return nil
+			}
+			return err
+		}
+
+		C.av_packet_rescale_ts(pktEnc, ctxEnc.time_base, C.get_nth_stream(ctxFmtOut, 0).time_base)
+		err = avop(C.av_write_frame(ctxFmtOut, pktEnc))
+		C.av_packet_unref(pktEnc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Creates an animated WEBP preview, 180 pixels high
+// pathIn: video filepath
+// clips: number of clips, spaced out the same way as CreateThumbnails
+//
+// Videos which can't seek error out, a preview of the first second isn't worth much
+func CreateAnimatedPreview(pathIn string, clips int) ([]byte, error) {
+	var ctxFmtIn *C.AVFormatContext = nil
+	pathInArg := C.CString(pathIn)
+	defer C.free(unsafe.Pointer(pathInArg))
+
+	err := avop(C.avformat_open_input(&ctxFmtIn, pathInArg, nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer C.avformat_close_input(&ctxFmtIn)
+
+	err = avop(C.avformat_find_stream_info(ctxFmtIn, nil))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	idxStream, ctxDec, err := OpenBestStream(ctxFmtIn, C.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return nil, err
+	}
+	defer C.avcodec_free_context(&ctxDec)
+
+	// Encoders want even dimensions for 4:2:0
+	imgH := 180
+	stream := C.get_nth_stream(ctxFmtIn, idxStream)
+	imgW := displayWidth(stream, ctxDec, imgH) &^ 1
+
+	ctxFmtOut, ctxEnc, err := CreateEncoderWEBPAnim(imgW, imgH, previewFps)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+	defer C.avformat_free_context(ctxFmtOut)
+	defer C.avcodec_free_context(&ctxEnc)
+	defer freeOutput(ctxFmtOut)
+
+	graph, ctxSrc, ctxSnk, err := InitFiltersScaling(ctxEnc, ctxDec, stream, false)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+	defer C.avfilter_graph_free(&graph)
+
+	// Frames are picked by counting rather than by timestamp
+	// Plenty of files have missing or nonsense timestamps
+	frameRate := C.av_q2d(stream.avg_frame_rate)
+	skip := max(1, int(math.Round(float64(frameRate)*clipStride)))
+
+	pktDec := C.av_packet_alloc()
+	defer C.av_packet_free(&pktDec)
+
+	pktEnc := C.av_packet_alloc()
+	defer C.av_packet_free(&pktEnc)
+
+	frame := C.av_frame_alloc()
+	defer C.av_frame_free(&frame)
+
+	frameFiltered := C.av_frame_alloc()
+	defer C.av_frame_free(&frameFiltered)
+
+	pts := C.int64_t(0)
+	step := 1.0 / float64(clips)
+	for i := 0; i < clips; i++ {
+		err = seekFraction(ctxFmtIn, idxStream, step/2.0+step*float64(i))
+		if err != nil {
+			return nil, err
+		}
+		C.avcodec_flush_buffers(ctxDec)
+
+		taken := 0
+		for decoded := 0; taken < framesPerClip; decoded++ {
+			err = decodeNextFrame(ctxFmtIn, ctxDec, idxStream, pktDec, frame)
+			if err != nil {
+				break
+			}
+
+			if decoded%skip != 0 {
+				continue
+			}
+
+			err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, frame, 0))
+			if err != nil {
+				log.Printf("%s: %s\n", pathIn, err)
+				return nil, err
+			}
+
+			err = avop(C.av_buffersink_get_frame(ctxSnk, frameFiltered))
+			if err != nil {
+				log.Printf("%s: %s\n", pathIn, err)
+				return nil, err
+			}
+
+			frameFiltered.pts = pts
+			pts++
+
+			err = avop(C.avcodec_send_frame(ctxEnc, frameFiltered))
+			C.av_frame_unref(frameFiltered)
+			if err != nil {
+				log.Printf("%s: %s\n", pathIn, err)
+				return nil, err
+			}
+
+			err = writePackets(ctxFmtOut, ctxEnc, pktEnc)
+			if err != nil {
+				log.Printf("%s: %s\n", pathIn, err)
+				return nil, err
+			}
+
+			taken++
+		}
+	}
+
+	if pts == 0 {
+		return nil, errors.New("No frames decoded for preview")
+	}
+
+	err = avop(C.avcodec_send_frame(ctxEnc, nil))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	err = writePackets(ctxFmtOut, ctxEnc, pktEnc)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	err = avop(C.av_write_trailer(ctxFmtOut))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	return takeOutput(ctxFmtOut), nil
+}
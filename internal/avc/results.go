@@ -0,0 +1,22 @@
+//Results shared by the libav code and its ffmpegcli stand-ins
+
+package avc
+
+// A position worth probing for a thumbnail
+// Pos is 0.0 to 1.0 through the video, same as CreateThumbnailX
+// Promise is how good it looks, higher is better
+type Candidate struct {
+	Pos     float64
+	Promise float64
+}
+
+// Everything needed to find a tile again
+// Tile i covers i*Interval to (i+1)*Interval seconds
+// and sits at column i%Columns, row i/Columns
+type SpriteSheet struct {
+	Interval float64
+	Count    int
+	Columns  int
+	TileW    int
+	TileH    int
+}
@@ -0,0 +1,219 @@
+//go:build !ffmpegcli
+
+// Scene analysis for picking thumbnail positions
+// Random positions happily land on fades, credits and black frames
+// Instead, take a quick pass over the keyframes and rank them
+// Only keyframes are decoded and only at 64x36 grey, so this is cheap next to a real thumbnail
+
+package avc
+
+/*
+#include "helpers.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"log"
+	"math"
+	"slices"
+	"unsafe"
+)
+
+const sceneW = 64
+const sceneH = 36
+const sceneBins = 32
+
+type keyframeStats struct {
+	pos     float64
+	promise float64
+	hist    [sceneBins]float64
+}
+
+// Normalised luma histogram, and a score for how well exposed the frame looks
+// Too dark, too bright and too flat all score low, mostly-black scores zero
+func frameStats(frame *C.AVFrame) ([sceneBins]float64, float64) {
+	var hist [sceneBins]float64
+
+	stride := int(frame.linesize[0])
+	plane := unsafe.Slice((*byte)(unsafe.Pointer(frame.data[0])), stride*sceneH)
+
+	sum := 0.0
+	sumSq := 0.0
+	dark := 0
+	for y := 0; y < sceneH; y++ {
+		for x := 0; x < sceneW; x++ {
+			v := plane[y*stride+x]
+			hist[int(v)*sceneBins/256] += 1
+			sum += float64(v)
+			sumSq += float64(v) * float64(v)
+			if v < 24 {
+				dark++
+			}
+		}
+	}
+
+	n := float64(sceneW * sceneH)
+	for i := range hist {
+		hist[i] /= n
+	}
+
+	if float64(dark)/n > 0.8 {
+		return hist, 0
+	}
+
+	mean := sum / n
+	stddev := math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+
+	exposure := math.Max(0, 1-math.Abs(mean-118)/118)
+	contrast := math.Min(stddev/50, 1)
+
+	return hist, exposure * contrast
+}
+
+// 0.0 for identical histograms, 1.0 for completely different
+func histDiff(a, b [sceneBins]float64) float64 {
+	diff := 0.0
+	for i := range a {
+		diff += math.Abs(a[i] - b[i])
+	}
+	return diff / 2
+}
+
+// Runs through the keyframes of a video and proposes up to num distinct, well exposed positions
+// Best first
+//
+// Keyframes are rewarded for looking different from the one before (a new scene)
+// Ones near the very start and end are penalised, that's where titles and credits live
+func SceneCandidates(pathIn string, num int) ([]Candidate, error) {
+	var ctxFmtIn *C.AVFormatContext = nil
+	pathInArg := C.CString(pathIn)
+	defer C.free(unsafe.Pointer(pathInArg))
+
+	err := avop(C.avformat_open_input(&ctxFmtIn, pathInArg, nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer C.avformat_close_input(&ctxFmtIn)
+
+	err = avop(C.avformat_find_stream_info(ctxFmtIn, nil))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	if ctxFmtIn.duration <= 0 {
+		return nil, errors.New("Unknown duration")
+	}
+	duration := durationSeconds(ctxFmtIn)
+
+	idxStream, ctxDec, err := OpenBestStream(ctxFmtIn, C.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return nil, err
+	}
+	defer C.avcodec_free_context(&ctxDec)
+
+	ctxDec.skip_frame = C.AVDISCARD_NONKEY
+	stream := C.get_nth_stream(ctxFmtIn, idxStream)
+
+	graph, ctxSrc, ctxSnk, err := InitFiltersScalingTo(ctxDec, stream, sceneW, sceneH, C.AV_PIX_FMT_GRAY8, false)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+	defer C.avfilter_graph_free(&graph)
+
+	pktDec := C.av_packet_alloc()
+	defer C.av_packet_free(&pktDec)
+
+	frame := C.av_frame_alloc()
+	defer C.av_frame_free(&frame)
+
+	frameFiltered := C.av_frame_alloc()
+	defer C.av_frame_free(&frameFiltered)
+
+	keyframes := make([]keyframeStats, 0, 100)
+	for true {
+		err = decodeNextFrame(ctxFmtIn, ctxDec, idxStream, pktDec, frame)
+		if err != nil {
+			break
+		}
+
+		if C.has_timestamp(frame.best_effort_timestamp) == 0 {
+			continue
+		}
+		// Measured from the start of the stream, which needn't be zero
+		// Container and stream durations disagree a little, so the ends are clamped rather than dropped
+		pos := min(max(streamSeconds(stream, frame.best_effort_timestamp)/duration, 0), 1)
+
+		err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, frame, 0))
+		if err != nil {
+			log.Printf("%s: %s\n", pathIn, err)
+			return nil, err
+		}
+
+		err = avop(C.av_buffersink_get_frame(ctxSnk, frameFiltered))
+		if err != nil {
+			log.Printf("%s: %s\n", pathIn, err)
+			return nil, err
+		}
+
+		hist, promise := frameStats(frameFiltered)
+		C.av_frame_unref(frameFiltered)
+
+		change := 1.0
+		if len(keyframes) > 0 {
+			change = histDiff(hist, keyframes[len(keyframes)-1].hist)
+		}
+		promise *= 0.3 + 0.7*change
+
+		if pos < 0.03 || pos > 0.9 {
+			promise *= 0.5
+		}
+
+		keyframes = append(keyframes, keyframeStats{pos: pos, promise: promise, hist: hist})
+	}
+
+	if err != nil && err.Error() != "End of file" {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	slices.SortFunc(keyframes, func(a, b keyframeStats) int {
+		if a.promise > b.promise {
+			return -1
+		}
+		if a.promise < b.promise {
+			return 1
+		}
+		return 0
+	})
+
+	// Greedily take the best, skipping anything too close in time or too alike to one already taken
+	minGap := 0.5 / float64(num)
+	chosen := make([]keyframeStats, 0, num)
+	for _, kf := range keyframes {
+		if len(chosen) >= num || kf.promise <= 0 {
+			break
+		}
+
+		distinct := true
+		for _, c := range chosen {
+			if math.Abs(c.pos-kf.pos) < minGap || histDiff(c.hist, kf.hist) < 0.15 {
+				distinct = false
+				break
+			}
+		}
+
+		if distinct {
+			chosen = append(chosen, kf)
+		}
+	}
+
+	candidates := make([]Candidate, 0, len(chosen))
+	for _, c := range chosen {
+		candidates = append(candidates, Candidate{Pos: c.pos, Promise: c.promise})
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,189 @@
+//go:build !ffmpegcli
+
+// Sprite sheets for seek bar scrubbing
+// Frames at a fixed interval, shrunk down and tiled into one big WEBP
+// A WebVTT track then maps time ranges onto tiles
+
+package avc
+
+/*
+#include "helpers.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"log"
+	"math"
+	"unsafe"
+)
+
+const spriteColumns = 10
+const spriteTileH = 90
+
+// WEBP tops out at 16383 pixels a side, so the tile count has to be capped
+// Long videos get a longer interval instead
+const spriteMaxTiles = 1000
+
+// Copies a YUV420P frame into a bigger YUV420P frame at x, y
+// x and y need to be even so the chroma planes line up
+func blitFrame(dst, src *C.AVFrame, x, y int) {
+	for i := 0; i < 3; i++ {
+		shift := 0
+		if i > 0 {
+			shift = 1
+		}
+
+		rows := int(src.height) >> shift
+		cols := int(src.width) >> shift
+		strideSrc := int(src.linesize[i])
+		strideDst := int(dst.linesize[i])
+
+		planeSrc := unsafe.Slice((*byte)(unsafe.Pointer(src.data[i])), strideSrc*rows)
+		planeDst := unsafe.Slice((*byte)(unsafe.Pointer(dst.data[i])), strideDst*(int(dst.height)>>shift))
+
+		for row := 0; row < rows; row++ {
+			offDst := ((y>>shift)+row)*strideDst + (x >> shift)
+			copy(planeDst[offDst:offDst+cols], planeSrc[row*strideSrc:row*strideSrc+cols])
+		}
+	}
+}
+
+// Creates a WEBP sprite sheet of frames every interval seconds
+// pathIn: video filepath
+//
+// Each tile is the first frame decoded after seeking to the middle of its interval
+// Tiles which fail to decode are left black rather than failing the whole sheet
+func CreateSpriteSheet(pathIn string, interval float64) ([]byte, SpriteSheet, error) {
+	var sheet SpriteSheet
+
+	var ctxFmtIn *C.AVFormatContext = nil
+	pathInArg := C.CString(pathIn)
+	defer C.free(unsafe.Pointer(pathInArg))
+
+	err := avop(C.avformat_open_input(&ctxFmtIn, pathInArg, nil, nil))
+	if err != nil {
+		return nil, sheet, err
+	}
+	defer C.avformat_close_input(&ctxFmtIn)
+
+	err = avop(C.avformat_find_stream_info(ctxFmtIn, nil))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, sheet, err
+	}
+
+	if ctxFmtIn.duration <= 0 {
+		return nil, sheet, errors.New("Unknown duration")
+	}
+	durationSeconds := float64(ctxFmtIn.duration) / float64(C.AV_TIME_BASE)
+
+	idxStream, ctxDec, err := OpenBestStream(ctxFmtIn, C.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return nil, sheet, err
+	}
+	defer C.avcodec_free_context(&ctxDec)
+
+	sheet.Interval = math.Max(interval, durationSeconds/spriteMaxTiles)
+	sheet.Count = int(math.Ceil(durationSeconds / sheet.Interval))
+	sheet.Columns = min(spriteColumns, sheet.Count)
+	sheet.TileH = spriteTileH
+	stream := C.get_nth_stream(ctxFmtIn, idxStream)
+	sheet.TileW = displayWidth(stream, ctxDec, spriteTileH) &^ 1
+
+	rows := (sheet.Count + sheet.Columns - 1) / sheet.Columns
+	imgW := sheet.Columns * sheet.TileW
+	imgH := rows * sheet.TileH
+
+	ctxFmtOut, ctxEnc, err := CreateEncoderWEBP(imgW, imgH)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, sheet, err
+	}
+	defer C.avformat_free_context(ctxFmtOut)
+	defer C.avcodec_free_context(&ctxEnc)
+	defer freeOutput(ctxFmtOut)
+
+	graph, ctxSrc, ctxSnk, err := InitFiltersScalingTo(ctxDec, stream, sheet.TileW, sheet.TileH, ctxEnc.pix_fmt, false)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, sheet, err
+	}
+	defer C.avfilter_graph_free(&graph)
+
+	frameSheet := C.av_frame_alloc()
+	defer C.av_frame_free(&frameSheet)
+
+	frameSheet.width = C.int(imgW)
+	frameSheet.height = C.int(imgH)
+	frameSheet.format = C.AV_PIX_FMT_YUV420P
+	err = avop(C.av_frame_get_buffer(frameSheet, 0))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, sheet, err
+	}
+
+	// Black to start with, limited range
+	for i := 0; i < 3; i++ {
+		shift := 0
+		fill := byte(128)
+		if i == 0 {
+			fill = 16
+		} else {
+			shift = 1
+		}
+		plane := unsafe.Slice((*byte)(unsafe.Pointer(frameSheet.data[i])), int(frameSheet.linesize[i])*(imgH>>shift))
+		for j := range plane {
+			plane[j] = fill
+		}
+	}
+
+	pktDec := C.av_packet_alloc()
+	defer C.av_packet_free(&pktDec)
+
+	frame := C.av_frame_alloc()
+	defer C.av_frame_free(&frame)
+
+	frameFiltered := C.av_frame_alloc()
+	defer C.av_frame_free(&frameFiltered)
+
+	for i := 0; i < sheet.Count; i++ {
+		pos := (float64(i) + 0.5) * sheet.Interval / durationSeconds
+		err = seekFraction(ctxFmtIn, idxStream, math.Min(pos, 1.0))
+		if err != nil {
+			return nil, sheet, err
+		}
+		C.avcodec_flush_buffers(ctxDec)
+
+		err = decodeNextFrame(ctxFmtIn, ctxDec, idxStream, pktDec, frame)
+		if err != nil {
+			continue
+		}
+
+		err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, frame, 0))
+		if err != nil {
+			log.Printf("%s: %s\n", pathIn, err)
+			return nil, sheet, err
+		}
+
+		err = avop(C.av_buffersink_get_frame(ctxSnk, frameFiltered))
+		if err != nil {
+			log.Printf("%s: %s\n", pathIn, err)
+			return nil, sheet, err
+		}
+
+		blitFrame(frameSheet, frameFiltered,
+			(i%sheet.Columns)*sheet.TileW,
+			(i/sheet.Columns)*sheet.TileH)
+
+		C.av_frame_unref(frameFiltered)
+	}
+
+	err = writeFrameWEBP(ctxFmtOut, ctxEnc, frameSheet)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, sheet, err
+	}
+
+	return takeOutput(ctxFmtOut), sheet, nil
+}
@@ -1,3 +1,5 @@
+//go:build !noopencv
+
 #include "thumbnailer.h"
 
 #include <vector>
@@ -10,6 +12,11 @@
 #include <opencv2/videoio.hpp> 
 
 #include <ranges>
+#include <algorithm>
+#include <cmath>
+#include <cstdlib>
+#include <cstring>
+#include <numeric>
 
 #include "util.hpp"
 
@@ -17,75 +24,236 @@ void cv_set_num_threads(int n) {
 	cv::setNumThreads(n);
 }
 
-thumbnailer *thumbnailer_init(char *path_model_detect, char *path_model_assess) {
-	return new thumbnailer(
-		std::string(path_model_detect), 
-		std::string(path_model_assess)
-	);
+static std::vector<unsigned char> model_bytes(model_buf m) {
+	return std::vector<unsigned char>(m.buf, m.buf + m.len);
+}
+
+// Models can come from the command line, one that won't load mustn't throw into Go
+thumbnailer *thumbnailer_init(model_buf detect, model_buf assess, model_buf embed, model_buf tag, float face_confidence, float face_nms) {
+	try {
+		return new thumbnailer(
+			model_bytes(detect),
+			model_bytes(assess),
+			model_bytes(embed),
+			model_bytes(tag),
+			face_confidence,
+			face_nms
+		);
+	} catch (const std::exception& e) {
+		std::cerr << "Failed to load models: " << e.what() << "\n";
+		return nullptr;
+	}
 }
 
 void thumbnailer_free(thumbnailer *t) {
 	delete t;
 }
 
-void thumbnailer_run(thumbnailer *t, char *path_in, char *path_out, int probes) {
-	t->run(
-		std::string(path_in), 
-		std::string(path_out), 
-		probes
-	);
+probe_set *thumbnailer_probe(thumbnailer *t, char *path_video, int probes) {
+	return new probe_set(t->probe_video(std::string(path_video), probes));
 }
 
-face_ret thumbnailer_run_image_buf(thumbnailer *t, unsigned char *buf, size_t buf_len) {
-	auto finds = t->run_image_buf(cv::Mat1b(1, static_cast<int>(buf_len), buf));
+size_t probe_set_len(probe_set *set) {
+	return set->probes.size();
+}
 
+probe probe_set_get(probe_set *set, size_t i) {
+	return set->probes.at(i);
+}
+
+void probe_set_free(probe_set *set) {
+	delete set;
+}
+
+// Every face found, however many, copied out somewhere C can hand to Go
+static face_ret face_results(const std::vector<face>& finds) {
 	auto results = face_ret {};
 	results.len = 0;
 
-	for (auto& find : finds) {
-		results.faces[results.len++] = find;
-		if (results.len >= 16) {
-			break;
-		}
+	if (finds.empty()) {
+		return results;
+	}
+
+	results.faces = static_cast<face*>(malloc(finds.size() * sizeof(face)));
+	if (results.faces == nullptr) {
+		return results;
+	}
+
+	std::copy(finds.begin(), finds.end(), results.faces);
+	results.len = finds.size();
+	return results;
+}
+
+face_ret thumbnailer_run_image_buf(thumbnailer *t, unsigned char *buf, size_t buf_len) {
+	return face_results(t->run_image_buf(cv::Mat1b(1, static_cast<int>(buf_len), buf)));
+}
+
+// One face_ret per image, in the same order, from one pass of the detector
+// The array is malloc'd, the caller frees it and each face_ret in it
+face_ret *thumbnailer_run_images_buf(thumbnailer *t, unsigned char **bufs, size_t *lens, size_t n) {
+	std::vector<cv::Mat1b> mats;
+	for (size_t i = 0; i < n; i++) {
+		mats.push_back(cv::Mat1b(1, static_cast<int>(lens[i]), bufs[i]));
+	}
+
+	auto batch = t->run_images_buf(mats);
+
+	auto results = static_cast<face_ret*>(calloc(n, sizeof(face_ret)));
+	if (results == nullptr) {
+		return results;
 	}
 
+	for (size_t i = 0; i < n; i++) {
+		results[i] = face_results(batch[i]);
+	}
 	return results;
 }
 
 face_ret thumbnailer_run_image(thumbnailer *t, char *path) {
-	auto finds = t->run_image(std::string(path));
+	return face_results(t->run_image(std::string(path)));
+}
 
-	auto results = face_ret {};
+void thumbnailer_free_faces(face_ret faces) {
+	free(faces.faces);
+}
+
+label_ret thumbnailer_classify_image_buf(thumbnailer *t, unsigned char *buf, size_t buf_len, float min_confidence) {
+	auto scores = t->classify_image_buf(cv::Mat1b(1, static_cast<int>(buf_len), buf));
+
+	std::vector<int> order(scores.size());
+	std::iota(order.begin(), order.end(), 0);
+	std::ranges::sort(order, std::ranges::greater{}, [&](int i) { return scores[i]; });
+
+	auto results = label_ret {};
 	results.len = 0;
 
-	for (auto& find : finds) {
-		results.faces[results.len++] = find;
-		if (results.len >= 16) {
+	for (auto i : order) {
+		if (scores[i] < min_confidence || results.len >= LABELS_MAX) {
 			break;
 		}
+		results.labels[results.len] = i;
+		results.confidences[results.len] = scores[i];
+		results.len++;
 	}
 
 	return results;
 }
 
-struct candidate {
-	cv::Mat image;
-	float quality;
-	float confidence;
-	int frame_pos;
-	int area;
-};
+assessment thumbnailer_assess_image_buf(unsigned char *buf, size_t buf_len) {
+	auto image = cv::imdecode(cv::Mat1b(1, static_cast<int>(buf_len), buf), cv::IMREAD_COLOR);
+	return assess_aesthetic(image);
+}
+
+// Scales and encodes a crop as WEBP into malloc'd memory
+static crop_ret encode_crop(const cv::Mat& crop, const cv::Size& size) {
+	auto results = crop_ret {};
+	if (crop.empty()) {
+		return results;
+	}
+
+	cv::Mat scaled;
+	cv::resize(crop, scaled, size, 0, 0, cv::INTER_AREA);
+
+	std::vector<unsigned char> encoded;
+	if (!cv::imencode(".webp", scaled, encoded)) {
+		return results;
+	}
+
+	results.data = static_cast<unsigned char*>(malloc(encoded.size()));
+	if (results.data == nullptr) {
+		return results;
+	}
+	std::memcpy(results.data, encoded.data(), encoded.size());
+	results.len = encoded.size();
+	return results;
+}
+
+// A probed frame as WEBP, data is malloc'd, the caller frees it
+crop_ret probe_set_image(probe_set *set, size_t i) {
+	if (i >= set->frames.size()) {
+		return crop_ret {};
+	}
+	return encode_crop(set->frames[i], set->frames[i].size());
+}
+
+// Square crop around a box given in fractions of the image, with some room around it
+// data is malloc'd, the caller frees it
+crop_ret thumbnailer_crop_image_buf(unsigned char *buf, size_t buf_len, float x, float y, float w, float h, int size) {
+	auto results = crop_ret {};
 
-thumbnailer::thumbnailer(const std::string& path_detect, const std::string& path_assess) :
-	face_finder(yolo(path_detect, path_assess))
+	auto image = cv::imdecode(cv::Mat1b(1, static_cast<int>(buf_len), buf), cv::IMREAD_COLOR);
+	if (image.empty()) {
+		return results;
+	}
+
+	auto cx = (x + w / 2) * image.cols;
+	auto cy = (y + h / 2) * image.rows;
+	auto side = 1.4f * std::max(w * image.cols, h * image.rows);
+	side = std::min({side, static_cast<float>(image.cols), static_cast<float>(image.rows)});
+	if (side < 1.f) {
+		return results;
+	}
+
+	// Slid back inside the image rather than shrunk, faces at the edge stay square
+	auto left = std::clamp(cx - side / 2, 0.f, image.cols - side);
+	auto top = std::clamp(cy - side / 2, 0.f, image.rows - side);
+	auto rect = cv::Rect2f(left, top, side, side) & cv::Rect2f(0, 0, image.cols, image.rows);
+
+	return encode_crop(image(cv::Rect2i(rect)), cv::Size(size, size));
+}
+
+// Biggest part of the image with the given aspect (width / height), centred on the focus where it fits
+// data is malloc'd, the caller frees it
+crop_ret thumbnailer_crop_focus_buf(unsigned char *buf, size_t buf_len, float focus_x, float focus_y, float aspect, int height) {
+	auto results = crop_ret {};
+	if (aspect <= 0.f || height < 1) {
+		return results;
+	}
+
+	auto image = cv::imdecode(cv::Mat1b(1, static_cast<int>(buf_len), buf), cv::IMREAD_COLOR);
+	if (image.empty()) {
+		return results;
+	}
+
+	auto w = static_cast<float>(image.cols);
+	auto h = static_cast<float>(image.rows);
+	if (w / h > aspect) {
+		w = h * aspect;
+	} else {
+		h = w / aspect;
+	}
+
+	auto left = std::clamp(focus_x * image.cols - w / 2, 0.f, image.cols - w);
+	auto top = std::clamp(focus_y * image.rows - h / 2, 0.f, image.rows - h);
+	auto rect = cv::Rect2f(left, top, w, h) & cv::Rect2f(0, 0, image.cols, image.rows);
+
+	auto width = std::max(1, static_cast<int>(std::round(height * aspect)));
+	return encode_crop(image(cv::Rect2i(rect)), cv::Size(width, height));
+}
+
+thumbnailer::thumbnailer(const std::vector<unsigned char>& model_detect, const std::vector<unsigned char>& model_assess, const std::vector<unsigned char>& model_embed, const std::vector<unsigned char>& model_tag, float face_confidence, float face_nms) :
+	face_finder(yolo(model_detect, model_assess, face_confidence, face_nms)),
+	embedder(face_embedder(model_embed)),
+	tagger(classifier(model_tag))
 {}
 
-void thumbnailer::run(const std::string& path_video, const std::string& path_out, int probes) {
-	auto cap = cv::VideoCapture(path_video, cv::CAP_FFMPEG);
+// Looks at probes evenly spaced frames in one pass over the video
+// Every frame is scored on its faces and looks, the caller picks which to keep
+// Detection goes a batch at a time, like the evaluator
+probe_set thumbnailer::probe_video(const std::string& path_video, int probes) {
+	probe_set set;
 
-	std::vector<candidate> candidates;
+	auto cap = cv::VideoCapture(path_video, cv::CAP_FFMPEG);
+	if (!cap.isOpened() || probes < 1) {
+		return set;
+	}
 
 	auto frame_count = static_cast<int>(cap.get(cv::CAP_PROP_FRAME_COUNT));
+	if (frame_count < 1) {
+		return set;
+	}
+
+	probes = std::min(probes, frame_count);
 	auto stride = frame_count / probes;
 	auto offset = stride / 2;
 	for (int i = 0; i < probes; i++) {
@@ -97,77 +265,133 @@ void thumbnailer::run(const std::string& path_video, const std::string& path_out
 			break;
 		}
 
-		auto finds = face_finder.find(frame);
-		if (finds.size() == 0) {
-			continue;
-		}
+		// Thumbnail sized, thirty full 4K frames would be a lot to hold on to
+		set.frames.push_back(image_scale(frame, 960, 540));
 
-		candidate x;
-		x.image = frame;
-		x.frame_pos = frame_pos;
-		x.quality = 0.0f;
-		x.confidence = 0.0f;
-		x.area = 0;
+		auto p = probe {};
+		p.pos = static_cast<float>(frame_pos) / frame_count;
+		set.probes.push_back(p);
+	}
 
-		for (auto find : finds) {
-			if (find.quality > x.quality) {
-				x.quality = find.quality;
+	const size_t batch = 8;
+	for (size_t start = 0; start < set.frames.size(); start += batch) {
+		auto end = std::min(start + batch, set.frames.size());
+		auto frames = std::vector<cv::Mat>(set.frames.begin() + start, set.frames.begin() + end);
+
+		auto found = face_finder.find_batch(frames);
+		for (size_t k = 0; k < found.size(); k++) {
+			auto& p = set.probes[start + k];
+			for (const auto& find : found[k]) {
+				p.faces++;
+				p.area += find.box_scaled.width * find.box_scaled.height;
+				p.confidence += find.confidence;
+				p.quality += find.quality;
 			}
 
-			if (find.confidence > x.confidence) {
-				x.confidence = find.confidence;
+			if (p.faces > 0) {
+				p.confidence /= p.faces;
+				p.quality /= p.faces;
 			}
-			auto area = find.box_scaled.width * find.box_scaled.height;
-			x.area += area;
-		}
 
-		if (x.area > 10000) {
-			candidates.push_back(x);
+			p.aesthetic = assess_aesthetic(frames[k]).aesthetic;
 		}
 	}
 
-	if (candidates.size() < 1) {
-		return;
-	}
+	return set;
+}
 
-	// Any quality above about 0.3f is just about guaranteed to be a full face
-	// Confidence seems to like bigger faces
-	std::ranges::sort(candidates, {}, [](const auto& c) { 
-		return c.confidence * std::min(c.quality, 0.4f);
-	});
-	std::ranges::reverse(candidates);
+std::vector<face> thumbnailer::run_image_buf(const cv::Mat1b& buf) {
+	return describe(cv::imdecode(buf, cv::IMREAD_COLOR));
+}
 
-	int count = 0;
-	for (const auto& candidate : candidates) {
-		count++;
-		if (count > 1) { break; }
-		cv::imwrite(path_out, image_scale(candidate.image, 960, 540));
+std::vector<std::vector<face>> thumbnailer::run_images_buf(const std::vector<cv::Mat1b>& bufs) {
+	std::vector<cv::Mat> images;
+	for (const auto& buf : bufs) {
+		images.push_back(buf.empty() ? cv::Mat() : cv::imdecode(buf, cv::IMREAD_COLOR));
 	}
+	return describe_batch(images);
 }
 
-std::vector<face> thumbnailer::run_image_buf(const cv::Mat1b& buf) {
-	auto image = cv::imdecode(buf, cv::IMREAD_COLOR);
+std::vector<float> thumbnailer::classify_image_buf(const cv::Mat1b& buf) {
+	return tagger.classify(cv::imdecode(buf, cv::IMREAD_COLOR));
+}
 
-	auto finds = face_finder.find(image);
+std::vector<face> thumbnailer::run_image(const std::string& path_image) {
+	return describe(cv::imread(path_image));
+}
 
-	auto results = std::vector<face>();
-	for (auto &find : finds) {
-		auto area = find.box_scaled.width * find.box_scaled.height;
-		results.push_back(face{area, find.confidence, find.quality});
+// Detection boxes and landmarks are in the detector's scaled and padded square
+// Undoing that gives fractions of the original image
+static void box_fractions(face& f, const proposal& find, const cv::Mat& image) {
+	auto side = static_cast<float>(find.image_work.cols);
+	auto ratio = std::min(side / image.cols, side / image.rows);
+	auto w = std::round(image.cols * ratio);
+	auto h = std::round(image.rows * ratio);
+	auto left = std::floor((side - w) / 2);
+	auto top = std::floor((side - h) / 2);
+
+	auto fx = [&](float x) { return std::clamp((x - left) / w, 0.f, 1.f); };
+	auto fy = [&](float y) { return std::clamp((y - top) / h, 0.f, 1.f); };
+
+	auto x0 = fx(find.box_scaled.x);
+	auto y0 = fy(find.box_scaled.y);
+	auto x1 = fx(find.box_scaled.x + find.box_scaled.width);
+	auto y1 = fy(find.box_scaled.y + find.box_scaled.height);
+
+	f.box_x = x0;
+	f.box_y = y0;
+	f.box_w = x1 - x0;
+	f.box_h = y1 - y0;
+
+	auto n = std::min(static_cast<int>(find.landmarks_scaled.size()), LANDMARKS);
+	for (int i = 0; i < n; i++) {
+		f.landmarks[2*i] = fx(find.landmarks_scaled[i].x);
+		f.landmarks[2*i+1] = fy(find.landmarks_scaled[i].y);
 	}
-	return results;
 }
 
-std::vector<face> thumbnailer::run_image(const std::string& path_image) {
-	auto image = cv::imread(path_image);
+std::vector<face> thumbnailer::describe(const cv::Mat& image) {
+	return describe_batch({image})[0];
+}
 
-	auto finds = face_finder.find(image);
+// Images that didn't decode are left out of the batch, they have no faces
+std::vector<std::vector<face>> thumbnailer::describe_batch(const std::vector<cv::Mat>& images) {
+	std::vector<std::vector<face>> results(images.size());
 
-	auto results = std::vector<face>();
-	for (auto &find : finds) {
-		auto area = find.box_scaled.width * find.box_scaled.height;
-		results.push_back(face{area, find.confidence, find.quality});
+	std::vector<cv::Mat> decoded;
+	std::vector<size_t> index;
+	for (size_t i = 0; i < images.size(); i++) {
+		if (!images[i].empty()) {
+			decoded.push_back(images[i]);
+			index.push_back(i);
+		}
+	}
+
+	if (decoded.empty()) {
+		return results;
+	}
+
+	auto batch = face_finder.find_batch(decoded);
+	for (size_t k = 0; k < batch.size(); k++) {
+		results[index[k]] = describe_finds(batch[k], decoded[k]);
 	}
 	return results;
 }
 
+std::vector<face> thumbnailer::describe_finds(const std::vector<proposal>& finds, const cv::Mat& image) {
+	auto results = std::vector<face>();
+	for (const auto &find : finds) {
+		face f = {};
+		f.area = find.box_scaled.width * find.box_scaled.height;
+		f.confidence = find.confidence;
+		f.quality = find.quality;
+		box_fractions(f, find, image);
+
+		auto embedding = embedder.embed(find.image_face);
+		f.embedding_len = std::min(static_cast<int>(embedding.size()), EMBEDDING_MAX);
+		std::copy_n(embedding.begin(), f.embedding_len, f.embedding);
+
+		results.push_back(f);
+	}
+	return results;
+}
@@ -0,0 +1,137 @@
+//Thumbnailer
+// Face finding, face embedding, tagging and probing, all of it OpenCV's DNN module underneath
+// OpenCV is a big dependency to ask for, so it sits behind an interface
+// Builds tagged noopencv get a stand-in that finds nothing, see noopencv.go
+
+package avc
+
+type Thumbnailer interface {
+	// Changes whenever the face models or their thresholds do
+	// Faces found under another version are out of date
+	FaceVersion() string
+
+	// Just the embedding model, embeddings from the same one can be compared
+	// Empty without one, faces then have no embeddings
+	EmbedVersion() string
+
+	// Same as FaceVersion, for the tagger
+	// Empty without one, nothing gets labels
+	TagVersion() string
+
+	RunImageBuf(image []byte) ([]Face, error)
+
+	// Faces in each of images, looked for in one pass of the detector
+	// Much quicker per image than RunImageBuf, up to cfg.FaceBatch or so at a time
+	RunImagesBuf(images [][]byte) ([][]Face, error)
+
+	// Labels at least TagConfidence sure, most confident first
+	ClassifyImageBuf(image []byte) ([]Label, error)
+
+	// Looks at probes evenly spaced frames of the video in one pass, scoring every one
+	// Much cheaper than a CreateThumbnailX per frame, the file is only opened once
+	Probe(pathVideo string, probes int) (ProbeSet, error)
+
+	Close()
+}
+
+// Frames from one Thumbnailer.Probe, Close when done with them
+type ProbeSet interface {
+	Probes() []Probe
+
+	// The ith probed frame as WEBP, thumbnail sized
+	Image(i int) ([]byte, error)
+
+	Close()
+}
+
+// Model paths left empty use the built in model
+// Except EmbedModel and TagModel, which have none, faces go without embeddings and thumbnails without labels
+// TagModel is any 224x224 classifier with ImageNet normalisation, e.g. a MobileNet or EfficientNet
+// TagLabels has one label per line, in the model's output order
+type ThumbnailerConfig struct {
+	Threads int
+
+	// Thumbnails handed to the face detector in one go
+	// More is quicker per thumbnail, up to whatever the CPU's caches take
+	FaceBatch int
+
+	DetectModel string
+	AssessModel string
+	EmbedModel  string
+	TagModel    string
+	TagLabels   string
+
+	// Faces less likely than FaceConfidence are dropped
+	// Overlapping boxes past FaceNMS are taken as the same face
+	FaceConfidence float32
+	FaceNMS        float32
+
+	// Labels less sure than this aren't kept
+	// Classifiers spread their guesses thin, anything past half is fairly certain
+	TagConfidence float32
+}
+
+func DefaultThumbnailerConfig() ThumbnailerConfig {
+	return ThumbnailerConfig{
+		Threads:        2,
+		FaceBatch:      8,
+		FaceConfidence: 0.6,
+		FaceNMS:        0.5,
+		TagConfidence:  0.5,
+	}
+}
+
+type Face struct {
+	Area       int64
+	Confidence float32
+	Quality    float32
+	Box        Box
+
+	// Eyes, nose, then mouth corners, as fractions like Box
+	Landmarks []Point
+
+	// Unit length, faces of the same person have a high dot product
+	Embedding []float32
+}
+
+// Fractions of the image's width and height, top left is 0, 0
+type Box struct {
+	X float32
+	Y float32
+	W float32
+	H float32
+}
+
+type Point struct {
+	X float32
+	Y float32
+}
+
+// Technical quality of an image, everything 0.0 to 1.0
+// Aesthetic is the combination of the others, and is zero for black frames
+type Aesthetic struct {
+	Sharpness     float32
+	Exposure      float32
+	Colourfulness float32
+	Aesthetic     float32
+
+	// The most eye-catching point, crops without faces go around it
+	Focus Point
+}
+
+// Something the classifier thinks is in an image
+type Label struct {
+	Name       string
+	Confidence float32
+}
+
+// One probed frame, Pos is a fraction of the duration like CreateThumbnailX takes
+// Area is summed over the faces, Confidence and Quality averaged, as the evaluator does
+type Probe struct {
+	Pos        float64
+	Faces      int
+	Area       int64
+	Confidence float32
+	Quality    float32
+	Aesthetic  float32
+}
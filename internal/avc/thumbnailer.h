@@ -1,39 +1,154 @@
 #pragma once
 
+#include <stddef.h>
+
+// Longest face embedding there's room for
+// ArcFace-style models give 512, MobileFaceNet 128
+#define EMBEDDING_MAX 512
+
+// Points per face: eyes, nose, mouth corners
+#define LANDMARKS 5
+
+// Most labels one image gets
+#define LABELS_MAX 8
+
+// An ONNX model's bytes, only needed until thumbnailer_init returns
+typedef struct model_buf_s {
+	unsigned char *buf;
+	size_t len;
+} model_buf;
+
 #ifdef __cplusplus
 #include "yolo.hpp"
+#include "aesthetic.hpp"
+#include "embed.hpp"
+#include "classify.hpp"
 struct face {
 	int area;
 	float confidence;
 	float quality;
+
+	// Fractions of the image, so they hold at any thumbnail size
+	float box_x;
+	float box_y;
+	float box_w;
+	float box_h;
+
+	// x, y pairs, fractions like the box
+	float landmarks[2*LANDMARKS];
+
+	int embedding_len;
+	float embedding[EMBEDDING_MAX];
 };
 
+// faces is malloc'd, thumbnailer_free_faces frees it
 struct face_ret {
-	face faces[16];
+	face *faces;
 	size_t len;
 };
 
+struct crop_ret {
+	unsigned char *data;
+	size_t len;
+};
+
+// Indexes into the model's label list, most confident first
+struct label_ret {
+	int labels[LABELS_MAX];
+	float confidences[LABELS_MAX];
+	size_t len;
+};
+
+// One frame looked at by thumbnailer::probe
+// area is summed over the faces, confidence and quality averaged, as the evaluator does
+struct probe {
+	float pos;
+	int faces;
+	int area;
+	float confidence;
+	float quality;
+	float aesthetic;
+};
+
+// Probed frames, kept at thumbnail size until the caller has picked which it wants
+struct probe_set {
+	std::vector<probe> probes;
+	std::vector<cv::Mat> frames;
+};
+
 class thumbnailer {
 public:
-	thumbnailer(const std::string& path_model_detect, const std::string& path_model_assess);
-	void run(const std::string& path_input, const std::string& path_output, int probes);
+	thumbnailer(const std::vector<unsigned char>& model_detect, const std::vector<unsigned char>& model_assess, const std::vector<unsigned char>& model_embed, const std::vector<unsigned char>& model_tag, float face_confidence, float face_nms);
+	probe_set probe_video(const std::string& path_video, int probes);
 	std::vector<face> run_image(const std::string& path_input);
 	std::vector<face> run_image_buf(const cv::Mat1b& buf);
+	std::vector<std::vector<face>> run_images_buf(const std::vector<cv::Mat1b>& bufs);
+	std::vector<float> classify_image_buf(const cv::Mat1b& buf);
 private:
 	yolo face_finder;
+	face_embedder embedder;
+	classifier tagger;
+
+	std::vector<face> describe(const cv::Mat& image);
+	std::vector<std::vector<face>> describe_batch(const std::vector<cv::Mat>& images);
+	std::vector<face> describe_finds(const std::vector<proposal>& finds, const cv::Mat& image);
 };
 #else
 typedef struct face_s {
 	int area;
 	float confidence;
 	float quality;
+
+	float box_x;
+	float box_y;
+	float box_w;
+	float box_h;
+
+	float landmarks[2*LANDMARKS];
+
+	int embedding_len;
+	float embedding[EMBEDDING_MAX];
 } face;
 
 typedef struct face_ret_s {
-	face faces[16];
+	face *faces;
 	size_t len;
 } face_ret;
 
+typedef struct crop_ret_s {
+	unsigned char *data;
+	size_t len;
+} crop_ret;
+
+typedef struct label_ret_s {
+	int labels[LABELS_MAX];
+	float confidences[LABELS_MAX];
+	size_t len;
+} label_ret;
+
+typedef struct assessment_s {
+	int valid;
+	float sharpness;
+	float exposure;
+	float colourfulness;
+	float aesthetic;
+	float focus_x;
+	float focus_y;
+} assessment;
+
+typedef struct probe_s {
+	float pos;
+	int faces;
+	int area;
+	float confidence;
+	float quality;
+	float aesthetic;
+} probe;
+
+typedef struct probe_set_s {
+	// nothing!
+} probe_set;
+
 typedef struct thumbnailer_s {
 	// nothing!
 } thumbnailer;
@@ -44,11 +159,22 @@ typedef struct thumbnailer_s {
 extern "C" {
 #endif
 
-extern thumbnailer *thumbnailer_init(char *path_model_detect, char *path_model_assess);
+// NULL if a model won't load
+extern thumbnailer *thumbnailer_init(model_buf detect, model_buf assess, model_buf embed, model_buf tag, float face_confidence, float face_nms);
 extern void thumbnailer_free(thumbnailer*);
-extern void thumbnailer_run(thumbnailer *t, char *path_video, char *path_thumb, int probes);
+extern probe_set *thumbnailer_probe(thumbnailer *t, char *path_video, int probes);
+extern size_t probe_set_len(probe_set *set);
+extern probe probe_set_get(probe_set *set, size_t i);
+extern crop_ret probe_set_image(probe_set *set, size_t i);
+extern void probe_set_free(probe_set *set);
 extern face_ret thumbnailer_run_image(thumbnailer *t, char *path_image);
 extern face_ret thumbnailer_run_image_buf(thumbnailer *t, unsigned char *buf, size_t len);
+extern face_ret *thumbnailer_run_images_buf(thumbnailer *t, unsigned char **bufs, size_t *lens, size_t n);
+extern void thumbnailer_free_faces(face_ret faces);
+extern label_ret thumbnailer_classify_image_buf(thumbnailer *t, unsigned char *buf, size_t len, float min_confidence);
+extern assessment thumbnailer_assess_image_buf(unsigned char *buf, size_t len);
+extern crop_ret thumbnailer_crop_image_buf(unsigned char *buf, size_t len, float x, float y, float w, float h, int size);
+extern crop_ret thumbnailer_crop_focus_buf(unsigned char *buf, size_t len, float focus_x, float focus_y, float aspect, int height);
 extern void cv_set_num_threads(int n);
 
 #ifdef __cplusplus
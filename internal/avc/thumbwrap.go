@@ -1,4 +1,7 @@
+//go:build !noopencv
+
 //Wrapper for thumbnailer.cpp
+// Left out of builds tagged noopencv, see noopencv.go
 
 package avc
 
@@ -15,73 +18,160 @@ size_t face_size(void) { return sizeof(face); }
 import "C"
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"unsafe"
 )
 
-import _ "embed"
-
-//go:embed weights/face-quality-assessment.onnx
-var netAssess []byte
-
-//go:embed weights/yolov8n-face.onnx
-var netDetect []byte
+type cvThumbnailer struct {
+	tmb    *C.thumbnailer
+	cfg    ThumbnailerConfig
+	labels []string
 
-type Thumbnailer struct {
-	tmb *C.thumbnailer
+	faceVersion  string
+	embedVersion string
+	tagVersion   string
 }
 
-type Face struct {
-	Area       int64
-	Confidence float32
-	Quality    float32
-}
+const OpenCV = true
 
-func NewThumbnailer(numThreads int) (*Thumbnailer, error) {
-	C.cv_set_num_threads(C.int(numThreads))
+func NewThumbnailer(cfg ThumbnailerConfig) (Thumbnailer, error) {
+	C.cv_set_num_threads(C.int(cfg.Threads))
 
-	fileDetect, err := os.CreateTemp(os.TempDir(), "http-server-av.yolov8n-face.*.onnx")
+	models, err := loadModels(cfg)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
-	defer os.Remove(fileDetect.Name())
 
-	fileAssess, err := os.CreateTemp(os.TempDir(), "http-server-av.face-quality-assessment.*.onnx")
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	m1 := modelBuf(models.detect)
+	defer C.free(unsafe.Pointer(m1.buf))
+
+	m2 := modelBuf(models.assess)
+	defer C.free(unsafe.Pointer(m2.buf))
+
+	m3 := modelBuf(models.embed)
+	defer C.free(unsafe.Pointer(m3.buf))
+
+	m4 := modelBuf(models.tag)
+	defer C.free(unsafe.Pointer(m4.buf))
+
+	tmber := C.thumbnailer_init(m1, m2, m3, m4, C.float(cfg.FaceConfidence), C.float(cfg.FaceNMS))
+	if tmber == nil {
+		return nil, errors.New("Failed to load models, check -facemodel, -qualitymodel, -embedmodel and -tagmodel")
 	}
-	defer os.Remove(fileAssess.Name())
 
-	err = os.WriteFile(fileDetect.Name(), netDetect, 0666)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	return &cvThumbnailer{
+		tmb:          tmber,
+		cfg:          cfg,
+		labels:       models.labels,
+		faceVersion:  models.faceVersion(cfg),
+		embedVersion: models.embed.digest,
+		tagVersion:   models.tagVersion(cfg),
+	}, nil
+}
+
+// A C copy of the model, the caller frees buf once the thumbnailer is made
+func modelBuf(m model) C.model_buf {
+	return C.model_buf{
+		buf: (*C.uchar)(C.CBytes(m.data)),
+		len: C.size_t(len(m.data)),
 	}
+}
 
-	err = os.WriteFile(fileAssess.Name(), netAssess, 0666)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+func (t *cvThumbnailer) FaceVersion() string {
+	return t.faceVersion
+}
+
+func (t *cvThumbnailer) EmbedVersion() string {
+	return t.embedVersion
+}
+
+func (t *cvThumbnailer) TagVersion() string {
+	return t.tagVersion
+}
+
+func AssessImageBuf(image []byte) (Aesthetic, error) {
+	buf := C.CBytes(image)
+	defer C.free(buf)
+
+	res := C.thumbnailer_assess_image_buf((*C.uchar)(buf), (C.size_t)(len(image)))
+	if res.valid == 0 {
+		return Aesthetic{}, errors.New("Failed to read image")
 	}
 
-	m1 := C.CString(fileDetect.Name())
-	defer C.free(unsafe.Pointer(m1))
+	return Aesthetic{
+		Sharpness:     float32(res.sharpness),
+		Exposure:      float32(res.exposure),
+		Colourfulness: float32(res.colourfulness),
+		Aesthetic:     float32(res.aesthetic),
+		Focus: Point{
+			X: float32(res.focus_x),
+			Y: float32(res.focus_y),
+		},
+	}, nil
+}
+
+func (t *cvThumbnailer) ClassifyImageBuf(image []byte) ([]Label, error) {
+	buf := C.CBytes(image)
+	defer C.free(buf)
+
+	res := C.thumbnailer_classify_image_buf(t.tmb, (*C.uchar)(buf), (C.size_t)(len(image)), C.float(t.cfg.TagConfidence))
 
-	m2 := C.CString(fileAssess.Name())
-	defer C.free(unsafe.Pointer(m2))
+	labels := make([]Label, int(res.len))
+	for i := range labels {
+		idx := int(res.labels[i])
+		name := fmt.Sprintf("label%d", idx)
+		if idx < len(t.labels) {
+			name = t.labels[idx]
+		}
 
-	tmber := C.thumbnailer_init(m1, m2)
-	return &Thumbnailer{tmb: tmber}, nil
+		labels[i] = Label{
+			Name:       name,
+			Confidence: float32(res.confidences[i]),
+		}
+	}
+
+	return labels, nil
 }
 
-func (t *Thumbnailer) Close() {
+// Square WEBP of the box and a bit around it, size pixels across
+func CropImageBuf(image []byte, box Box, size int) ([]byte, error) {
+	buf := C.CBytes(image)
+	defer C.free(buf)
+
+	res := C.thumbnailer_crop_image_buf((*C.uchar)(buf), (C.size_t)(len(image)),
+		C.float(box.X), C.float(box.Y), C.float(box.W), C.float(box.H), C.int(size))
+	if res.data == nil {
+		return nil, errors.New("Failed to crop image")
+	}
+	defer C.free(unsafe.Pointer(res.data))
+
+	return C.GoBytes(unsafe.Pointer(res.data), C.int(res.len)), nil
+}
+
+// The biggest part of the image with the aspect (width / height), as near centred on focus as fits
+// Comes out height pixels high
+func CropImageBufFocus(image []byte, focus Point, aspect float64, height int) ([]byte, error) {
+	buf := C.CBytes(image)
+	defer C.free(buf)
+
+	res := C.thumbnailer_crop_focus_buf((*C.uchar)(buf), (C.size_t)(len(image)),
+		C.float(focus.X), C.float(focus.Y), C.float(aspect), C.int(height))
+	if res.data == nil {
+		return nil, errors.New("Failed to crop image")
+	}
+	defer C.free(unsafe.Pointer(res.data))
+
+	return C.GoBytes(unsafe.Pointer(res.data), C.int(res.len)), nil
+}
+
+func (t *cvThumbnailer) Close() {
 	C.thumbnailer_free(t.tmb)
 }
 
-func (t *Thumbnailer) RunImageBuf(image []byte) ([]Face, error) {
+func (t *cvThumbnailer) RunImageBuf(image []byte) ([]Face, error) {
 	buf := C.CBytes(image)
 	defer C.free(buf)
 
@@ -90,44 +180,144 @@ func (t *Thumbnailer) RunImageBuf(image []byte) ([]Face, error) {
 	//end := time.Now()
 	//log.Printf("\t%s\n", end.Sub(start))
 
-	faces := make([]Face, int(finds.len))
-	for i := 0; i < int(finds.len); i++ {
-		faces[i] = Face{
-			Area:       int64(finds.faces[i].area),
-			Confidence: float32(finds.faces[i].confidence),
-			Quality:    float32(finds.faces[i].quality),
-		}
+	return goFaces(finds), nil
+}
+
+func (t *cvThumbnailer) RunImagesBuf(images [][]byte) ([][]Face, error) {
+	if len(images) == 0 {
+		return [][]Face{}, nil
+	}
+
+	n := len(images)
+	bufs := unsafe.Slice((**C.uchar)(C.malloc(C.size_t(n)*C.size_t(unsafe.Sizeof((*C.uchar)(nil))))), n)
+	defer C.free(unsafe.Pointer(&bufs[0]))
+
+	lens := unsafe.Slice((*C.size_t)(C.malloc(C.size_t(n)*C.size_t(unsafe.Sizeof(C.size_t(0))))), n)
+	defer C.free(unsafe.Pointer(&lens[0]))
+
+	for i, image := range images {
+		bufs[i] = (*C.uchar)(C.CBytes(image))
+		defer C.free(unsafe.Pointer(bufs[i]))
+		lens[i] = C.size_t(len(image))
+	}
+
+	res := C.thumbnailer_run_images_buf(t.tmb, &bufs[0], &lens[0], C.size_t(n))
+	if res == nil {
+		return nil, errors.New("Failed to run face batch")
+	}
+	defer C.free(unsafe.Pointer(res))
+
+	rets := unsafe.Slice(res, n)
+	faces := make([][]Face, n)
+	for i := range rets {
+		faces[i] = goFaces(rets[i])
 	}
 
 	return faces, nil
 }
 
-func (t *Thumbnailer) RunImage(path_image string) ([]Face, error) {
+func (t *cvThumbnailer) RunImage(path_image string) ([]Face, error) {
 	pin := C.CString(path_image)
 	defer C.free(unsafe.Pointer(pin))
 
 	finds := C.thumbnailer_run_image(t.tmb, pin)
 
-	faces := make([]Face, int(finds.len))
-	for i := 0; i < int(finds.len); i++ {
-		faces[i] = Face{
-			Area:       int64(finds.faces[i].area),
-			Confidence: float32(finds.faces[i].confidence),
-			Quality:    float32(finds.faces[i].quality),
+	return goFaces(finds), nil
+}
+
+// Frames held in C until Close
+type cvProbeSet struct {
+	set    *C.probe_set
+	probes []Probe
+}
+
+func (t *cvThumbnailer) Probe(pathVideo string, probes int) (ProbeSet, error) {
+	pin := C.CString(pathVideo)
+	defer C.free(unsafe.Pointer(pin))
+
+	set := C.thumbnailer_probe(t.tmb, pin, C.int(probes))
+	if set == nil {
+		return nil, errors.New("Failed to probe video")
+	}
+
+	n := int(C.probe_set_len(set))
+	res := &cvProbeSet{set: set, probes: make([]Probe, n)}
+	for i := range res.probes {
+		p := C.probe_set_get(set, C.size_t(i))
+		res.probes[i] = Probe{
+			Pos:        float64(p.pos),
+			Faces:      int(p.faces),
+			Area:       int64(p.area),
+			Confidence: float32(p.confidence),
+			Quality:    float32(p.quality),
+			Aesthetic:  float32(p.aesthetic),
 		}
 	}
 
-	return faces, nil
+	return res, nil
 }
 
-func (t *Thumbnailer) Run(path_video string, path_thumbnail string, probes int) error {
-	pin := C.CString(path_video)
-	defer C.free(unsafe.Pointer(pin))
+func (s *cvProbeSet) Probes() []Probe {
+	return s.probes
+}
 
-	pot := C.CString(path_thumbnail)
-	defer C.free(unsafe.Pointer(pot))
+func (s *cvProbeSet) Image(i int) ([]byte, error) {
+	if i < 0 || i >= len(s.probes) {
+		return nil, fmt.Errorf("No probe %d", i)
+	}
+
+	res := C.probe_set_image(s.set, C.size_t(i))
+	if res.data == nil {
+		return nil, errors.New("Failed to encode probe")
+	}
+	defer C.free(unsafe.Pointer(res.data))
 
-	C.thumbnailer_run(t.tmb, pin, pot, C.int(probes))
+	return C.GoBytes(unsafe.Pointer(res.data), C.int(res.len)), nil
+}
+
+func (s *cvProbeSet) Close() {
+	C.probe_set_free(s.set)
+}
+
+// Copies the faces out and frees them
+func goFaces(finds C.face_ret) []Face {
+	defer C.thumbnailer_free_faces(finds)
+	if finds.len == 0 {
+		return []Face{}
+	}
+
+	cfaces := unsafe.Slice(finds.faces, int(finds.len))
+	faces := make([]Face, len(cfaces))
+	for i := range cfaces {
+		find := &cfaces[i]
+
+		embedding := make([]float32, int(find.embedding_len))
+		for j := range embedding {
+			embedding[j] = float32(find.embedding[j])
+		}
+
+		landmarks := make([]Point, C.LANDMARKS)
+		for j := range landmarks {
+			landmarks[j] = Point{
+				X: float32(find.landmarks[2*j]),
+				Y: float32(find.landmarks[2*j+1]),
+			}
+		}
+
+		faces[i] = Face{
+			Area:       int64(find.area),
+			Confidence: float32(find.confidence),
+			Quality:    float32(find.quality),
+			Box: Box{
+				X: float32(find.box_x),
+				Y: float32(find.box_y),
+				W: float32(find.box_w),
+				H: float32(find.box_h),
+			},
+			Landmarks: landmarks,
+			Embedding: embedding,
+		}
+	}
 
-	return nil
+	return faces
 }
@@ -1,3 +1,5 @@
+//go:build !noopencv
+
 #include "util.hpp"
 
 float sigmoid_x(float x) {
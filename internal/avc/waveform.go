@@ -0,0 +1,413 @@
+//go:build !ffmpegcli
+
+// Waveform thumbnails for audio files without cover art
+// The showspectrumpic/showwavespic filters want the whole track in memory before drawing anything
+// So instead decode a chunk at a time and fold the samples into a fixed number of columns
+
+package avc
+
+/*
+#include "helpers.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"unsafe"
+)
+
+// Audio is resampled down to this before peaks are taken
+// Plenty for a 960 pixel wide picture and keeps the per-sample loop cheap
+const waveRate = 8000
+
+// One entry per output column, so memory is fixed regardless of track length
+type waveform struct {
+	lo        []float32
+	hi        []float32
+	crossings []int
+	counts    []int
+
+	expected float64
+	seen     int
+	last     float32
+}
+
+func newWaveform(width int, expected float64) *waveform {
+	return &waveform{
+		lo:        make([]float32, width),
+		hi:        make([]float32, width),
+		crossings: make([]int, width),
+		counts:    make([]int, width),
+		expected:  expected,
+	}
+}
+
+func (w *waveform) add(samples []float32) {
+	width := len(w.lo)
+	for _, s := range samples {
+		col := int(float64(w.seen) * float64(width) / w.expected)
+		if col >= width {
+			col = width - 1
+		}
+
+		if s < w.lo[col] {
+			w.lo[col] = s
+		}
+		if s > w.hi[col] {
+			w.hi[col] = s
+		}
+		if (s < 0) != (w.last < 0) {
+			w.crossings[col]++
+		}
+
+		w.last = s
+		w.counts[col]++
+		w.seen++
+	}
+}
+
+// Draws the waveform into a YUV420P frame
+// Bar height is the peak envelope, bar colour is the zero crossing rate
+// Crossing rate is a cheap stand-in for how bright/noisy the audio is
+// Speech, music and hiss come out in visibly different colours
+func (w *waveform) draw(frame *C.AVFrame) {
+	width := int(frame.width)
+	height := int(frame.height)
+
+	plane := func(i, rows int) ([]byte, int) {
+		stride := int(frame.linesize[i])
+		return unsafe.Slice((*byte)(unsafe.Pointer(frame.data[i])), stride*rows), stride
+	}
+	planeY, strideY := plane(0, height)
+	planeU, strideU := plane(1, height/2)
+	planeV, strideV := plane(2, height/2)
+
+	for i := range planeY {
+		planeY[i] = 16
+	}
+	for i := range planeU {
+		planeU[i] = 128
+	}
+	for i := range planeV {
+		planeV[i] = 128
+	}
+
+	peak := float32(0)
+	for i := range w.lo {
+		peak = max(peak, -w.lo[i], w.hi[i])
+	}
+	if peak == 0 {
+		peak = 1
+	}
+
+	mid := float32(height) / 2
+	for x := 0; x < width && x < len(w.lo); x++ {
+		if w.counts[x] == 0 {
+			continue
+		}
+
+		top := int(mid - (w.hi[x]/peak)*mid*0.9)
+		bottom := int(mid - (w.lo[x]/peak)*mid*0.9)
+		top = max(0, min(top, height-1))
+		bottom = max(top, min(bottom, height-1))
+
+		zcr := float64(w.crossings[x]) / float64(w.counts[x])
+		y, u, v := waveColour(zcr)
+
+		for row := top; row <= bottom; row++ {
+			planeY[row*strideY+x] = y
+			planeU[(row/2)*strideU+x/2] = u
+			planeV[(row/2)*strideV+x/2] = v
+		}
+	}
+}
+
+// Maps zero crossing rate onto a hue, blue for low rumbly stuff through to red for hiss
+// Returns limited range BT.601 YUV since that's what the encoder is fed
+func waveColour(zcr float64) (byte, byte, byte) {
+	hue := 240.0 - math.Min(zcr/0.25, 1.0)*240.0
+	sat := 0.8
+	val := 0.95
+
+	c := val * sat
+	h := hue / 60.0
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 1:
+		r, g, b = c, x, 0
+	case h < 2:
+		r, g, b = x, c, 0
+	case h < 3:
+		r, g, b = 0, c, x
+	case h < 4:
+		r, g, b = 0, x, c
+	case h < 5:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	m := val - c
+	r, g, b = r+m, g+m, b+m
+
+	y := 16 + 65.481*r + 128.553*g + 24.966*b
+	u := 128 - 37.797*r - 74.203*g + 112.0*b
+	v := 128 + 112.0*r - 93.786*g - 18.214*b
+	return byte(y), byte(u), byte(v)
+}
+
+// Resamples to mono float at waveRate, whatever the source looks like
+func InitFiltersWaveform(ctxDec *C.AVCodecContext) (*C.AVFilterGraph, *C.AVFilterContext, *C.AVFilterContext, error) {
+	layout := (*C.char)(C.malloc(64))
+	defer C.free(unsafe.Pointer(layout))
+
+	err := avop(C.describe_ch_layout(ctxDec, layout, 64))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	graph := C.avfilter_graph_alloc()
+
+	ctxSrc, err := createFilter(
+		"in",
+		"abuffer",
+		fmt.Sprintf("time_base=1/%d:sample_rate=%d:sample_fmt=%s:channel_layout=%s",
+			ctxDec.sample_rate, ctxDec.sample_rate,
+			C.GoString(C.av_get_sample_fmt_name(ctxDec.sample_fmt)),
+			C.GoString(layout)),
+		graph)
+	if err != nil {
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
+	ctxFmt, err := createFilter(
+		"format",
+		"aformat",
+		fmt.Sprintf("sample_fmts=flt:channel_layouts=mono:sample_rates=%d", waveRate),
+		graph)
+	if err != nil {
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
+	ctxSnk, err := createFilter("out", "abuffersink", "", graph)
+	if err != nil {
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
+	err = avop(C.avfilter_link(ctxSrc, 0, ctxFmt, 0))
+	if err != nil {
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
+	err = avop(C.avfilter_link(ctxFmt, 0, ctxSnk, 0))
+	if err != nil {
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
+	err = avop(C.avfilter_graph_config(graph, nil))
+	if err != nil {
+		C.avfilter_graph_free(&graph)
+		return nil, nil, nil, err
+	}
+
+	return graph, ctxSrc, ctxSnk, nil
+}
+
+// Creates a 960x540 WEBP of the audio waveform
+// pathIn: audio filepath
+//
+// Needs a known duration to lay out the columns, errors out without one
+func CreateWaveformThumbnail(pathIn string) ([]byte, error) {
+	imgH := 540
+	imgW := 960
+
+	var ctxFmtIn *C.AVFormatContext = nil
+	pathInArg := C.CString(pathIn)
+	defer C.free(unsafe.Pointer(pathInArg))
+
+	err := avop(C.avformat_open_input(&ctxFmtIn, pathInArg, nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer C.avformat_close_input(&ctxFmtIn)
+
+	err = avop(C.avformat_find_stream_info(ctxFmtIn, nil))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	if ctxFmtIn.duration <= 0 {
+		return nil, errors.New("Unknown duration")
+	}
+
+	idxStream, ctxDec, err := OpenBestStream(ctxFmtIn, C.AVMEDIA_TYPE_AUDIO)
+	if err != nil {
+		return nil, err
+	}
+	defer C.avcodec_free_context(&ctxDec)
+
+	graph, ctxSrc, ctxSnk, err := InitFiltersWaveform(ctxDec)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+	defer C.avfilter_graph_free(&graph)
+
+	durationSeconds := float64(ctxFmtIn.duration) / float64(C.AV_TIME_BASE)
+	wave := newWaveform(imgW, durationSeconds*waveRate)
+
+	pktDec := C.av_packet_alloc()
+	defer C.av_packet_free(&pktDec)
+
+	frame := C.av_frame_alloc()
+	defer C.av_frame_free(&frame)
+
+	frameFiltered := C.av_frame_alloc()
+	defer C.av_frame_free(&frameFiltered)
+
+	// Pulls everything the filter graph has ready into the waveform
+	drain := func() error {
+		for true {
+			rc := C.av_buffersink_get_frame(ctxSnk, frameFiltered)
+			if rc == -C.EAGAIN {
+				return nil
+			}
+			err := avop(rc)
+			if err != nil {
+				if err.Error() == "End of file" {
+					return nil
+				}
+				return err
+			}
+
+			samples := unsafe.Slice(
+				(*float32)(unsafe.Pointer(frameFiltered.data[0])),
+				int(frameFiltered.nb_samples))
+			wave.add(samples)
+
+			C.av_frame_unref(frameFiltered)
+		}
+		return nil
+	}
+
+	// Passes everything the decoder has ready through the filter graph
+	decode := func() error {
+		for true {
+			rc := C.avcodec_receive_frame(ctxDec, frame)
+			if rc == -C.EAGAIN {
+				return nil
+			}
+			err := avop(rc)
+			if err != nil {
+				if err.Error() == "End of file" {
+					return nil
+				}
+				return err
+			}
+
+			err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, frame, 0))
+			C.av_frame_unref(frame)
+			if err != nil {
+				return err
+			}
+
+			err = drain()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for true {
+		err = avop(C.av_read_frame(ctxFmtIn, pktDec))
+		if err != nil {
+			if err.Error() != "End of file" {
+				log.Printf("%s: %s\n", pathIn, err)
+				return nil, err
+			}
+			break
+		}
+
+		if pktDec.stream_index != C.int(idxStream) {
+			C.av_packet_unref(pktDec)
+			continue
+		}
+
+		// A damaged packet here and there shouldn't sink the whole picture
+		err = avop(C.avcodec_send_packet(ctxDec, pktDec))
+		C.av_packet_unref(pktDec)
+		if err != nil {
+			continue
+		}
+
+		err = decode()
+		if err != nil {
+			log.Printf("%s: %s\n", pathIn, err)
+			return nil, err
+		}
+	}
+
+	// Flush out the decoder then the filters
+	err = avop(C.avcodec_send_packet(ctxDec, nil))
+	if err == nil {
+		err = decode()
+	}
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	err = avop(C.av_buffersrc_add_frame_flags(ctxSrc, nil, 0))
+	if err == nil {
+		err = drain()
+	}
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	if wave.seen == 0 {
+		return nil, errors.New("No audio decoded")
+	}
+
+	frameOut := C.av_frame_alloc()
+	defer C.av_frame_free(&frameOut)
+
+	frameOut.width = C.int(imgW)
+	frameOut.height = C.int(imgH)
+	frameOut.format = C.AV_PIX_FMT_YUV420P
+	err = avop(C.av_frame_get_buffer(frameOut, 0))
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	wave.draw(frameOut)
+
+	ctxFmtOut, ctxEnc, err := CreateEncoderWEBP(imgW, imgH)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+	defer C.avformat_free_context(ctxFmtOut)
+	defer C.avcodec_free_context(&ctxEnc)
+	defer freeOutput(ctxFmtOut)
+
+	err = writeFrameWEBP(ctxFmtOut, ctxEnc, frameOut)
+	if err != nil {
+		log.Printf("%s: %s\n", pathIn, err)
+		return nil, err
+	}
+
+	return takeOutput(ctxFmtOut), nil
+}
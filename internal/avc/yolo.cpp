@@ -1,3 +1,5 @@
+//go:build !noopencv
+
 #include "yolo.hpp"
 #include <opencv2/imgproc.hpp>
 #include <algorithm>
@@ -9,14 +11,14 @@
 #include <ranges>
 
 yolo_face::yolo_face(
-	const std::string& path_model, 
+	const std::vector<unsigned char>& model, 
 	float confidence_threshold, 
 	float nms_threshold
 ) : 
 	confidence_threshold(confidence_threshold), 
 	nms_threshold(nms_threshold) 
 {
-	net = cv::dnn::readNet(path_model);
+	net = cv::dnn::readNetFromONNX(model);
 }
 
 std::vector<proposal> yolo_face::nms_filter(const std::vector<proposal>& proposals) {
@@ -64,11 +66,50 @@ cv::Rect2i scale_box(const cv::Rect2f& box, const cv::Mat& image, const cv::Mat&
 	return ret;
 }
 
-std::vector<proposal> yolo_face::detect(const cv::Mat& image_in) {
-	auto image = image_pad_square(image_scale(image_in, width, height));
+std::vector<cv::Point2f> scale_points(const std::vector<cv::Point2f>& points, const cv::Mat& image, const cv::Mat& output) {
+	auto stride = static_cast<int>(ceil(static_cast<float>(image.rows) / output.size[2]));
+	std::vector<cv::Point2f> ret;
+	for (const auto& point : points) {
+		ret.push_back(point * stride);
+	}
+	return ret;
+}
+
+std::vector<proposal> yolo_face::detect(const cv::Mat& image) {
+	return detect_batch({image})[0];
+}
+
+// All the images go through the network in one pass where the model allows it
+std::vector<std::vector<proposal>> yolo_face::detect_batch(const std::vector<cv::Mat>& images_in) {
+	std::vector<std::vector<proposal>> results(images_in.size());
+
+	std::vector<cv::Mat> images;
+	for (const auto& image_in : images_in) {
+		images.push_back(image_pad_square(image_scale(image_in, width, height)));
+	}
 
-	auto blob = cv::dnn::blobFromImage(
-		image, 
+	if (batchable && images.size() > 1) {
+		try {
+			auto outputs = forward(images);
+			for (size_t n = 0; n < images.size(); n++) {
+				results[n] = proposals_of(images[n], outputs, static_cast<int>(n));
+			}
+			return results;
+		} catch (const cv::Exception& e) {
+			std::cerr << "Face model won't batch, going one image at a time: " << e.what() << "\n";
+			batchable = false;
+		}
+	}
+
+	for (size_t n = 0; n < images.size(); n++) {
+		results[n] = proposals_of(images[n], forward({images[n]}), 0);
+	}
+	return results;
+}
+
+std::vector<cv::Mat> yolo_face::forward(const std::vector<cv::Mat>& images) {
+	auto blob = cv::dnn::blobFromImages(
+		images, 
 		1/255.0, // scalefactor
 		cv::Size(width, height), 
 		cv::Scalar(0, 0, 0), // mean
@@ -84,13 +125,23 @@ std::vector<proposal> yolo_face::detect(const cv::Mat& image_in) {
 	//const std::chrono::duration<double> elapsed{end - start};
 	//std::cout << elapsed << "\n";
 
+	return outputs;
+}
+
+// Proposals for the nth image of a batch
+std::vector<proposal> yolo_face::proposals_of(const cv::Mat& image, const std::vector<cv::Mat>& outputs, int n) {
 	std::vector<proposal> proposals;
 	for (const auto& output : outputs) {
-		for (auto& find : generate_proposals(output)) {
+		// A view of just this image's slice, shaped like a batch of one
+		int sizes[] = { 1, output.size[1], output.size[2], output.size[3] };
+		auto one = cv::Mat(4, sizes, CV_32F, const_cast<float*>(output.ptr<float>(n)));
+
+		for (auto& find : generate_proposals(one)) {
 			// Proposal bounding boxes are in output image space, e.g. tiny
 			// Scale them up
 			find.image_work = image;
-			find.box_scaled = scale_box(find.box_raw, image, output);
+			find.box_scaled = scale_box(find.box_raw, image, one);
+			find.landmarks_scaled = scale_points(find.landmarks_raw, image, one);
 			proposals.push_back(find);
 		}
 	}
@@ -149,9 +200,9 @@ std::vector<proposal> yolo_face::generate_proposals(const cv::Mat& output) {
 			prop.box_raw = cv::Rect2f(xmin, ymin, xmax-xmin, ymax-ymin);
 
 			for (int k = 0; k < 5; k++) {
-				prop.landmarks_raw.push_back(cv::Point(
-					static_cast<int>(ptr_kp[(k*3)*area+idx]*2+j),
-					static_cast<int>(ptr_kp[(k*3+1)*area+idx]*2+i)
+				prop.landmarks_raw.push_back(cv::Point2f(
+					ptr_kp[(k*3)*area+idx]*2+j,
+					ptr_kp[(k*3+1)*area+idx]*2+i
 				));
 			}
 
@@ -162,8 +213,8 @@ std::vector<proposal> yolo_face::generate_proposals(const cv::Mat& output) {
 	return proposals;
 }
 
-yolo_qual::yolo_qual(const std::string& path_model) {
-	net = cv::dnn::readNet(path_model);
+yolo_qual::yolo_qual(const std::vector<unsigned char>& model) {
+	net = cv::dnn::readNetFromONNX(model);
 }
 
 float yolo_qual::assess(const cv::Mat& image) {
@@ -204,27 +255,33 @@ cv::Mat yolo_qual::image_normalise(const cv::Mat& image) {
 	return normalised;
 }
 
-yolo::yolo(const std::string& path_model_detect) :
+yolo::yolo(const std::vector<unsigned char>& model_detect) :
 	use_qual(false),
-	face(path_model_detect, 0.60, 0.5)
+	face(model_detect, 0.60, 0.5)
 {}
 
-yolo::yolo(const std::string& path_model_detect, const std::string& path_model_assess) :
+yolo::yolo(const std::vector<unsigned char>& model_detect, const std::vector<unsigned char>& model_assess, float confidence_threshold, float nms_threshold) :
 	use_qual(true),
-	face(path_model_detect, 0.60, 0.5),
-	qual(path_model_assess)
+	face(model_detect, confidence_threshold, nms_threshold),
+	qual(model_assess)
 {}
 
 std::vector<proposal> yolo::find(const cv::Mat& image) {
-	auto finds = face.detect(image);
+	return find_batch({image})[0];
+}
+
+std::vector<std::vector<proposal>> yolo::find_batch(const std::vector<cv::Mat>& images) {
+	auto batch = face.detect_batch(images);
 	if (!use_qual) {
-		return finds; 
+		return batch; 
 	}
 
-	for (auto& find : finds) {
-		find.image_face = find.image_work(find.box_scaled);
-		find.quality = qual.assess(find.image_face);
+	for (auto& finds : batch) {
+		for (auto& find : finds) {
+			find.image_face = find.image_work(find.box_scaled);
+			find.quality = qual.assess(find.image_face);
+		}
 	}
-	return finds;
+	return batch;
 }
 
@@ -15,25 +15,32 @@ struct proposal {
 	cv::Rect2f box_raw;
 	cv::Rect2i box_scaled;
 
+	// Eyes, nose, mouth corners
 	std::vector<cv::Point2f> landmarks_raw;
-	std::vector<cv::Point2i> landmarks_scaled;
+	std::vector<cv::Point2f> landmarks_scaled;
 };
 
 class yolo_face {
 public:
 	yolo_face() = default;
-	yolo_face(const std::string& path_model, float confidence_threshold, float nms_threshold);
+	yolo_face(const std::vector<unsigned char>& model, float confidence_threshold, float nms_threshold);
 	std::vector<proposal> detect(const cv::Mat& image);
+	std::vector<std::vector<proposal>> detect_batch(const std::vector<cv::Mat>& images);
 
 private:
 	float confidence_threshold;
 	float nms_threshold;
 	cv::dnn::Net net;
 
+	// Models exported with a fixed batch size of one won't take more
+	bool batchable = true;
+
 	const int width = 640;
 	const int height = 640;
 	const int reg_max = 16;
 
+	std::vector<cv::Mat> forward(const std::vector<cv::Mat>& images);
+	std::vector<proposal> proposals_of(const cv::Mat& image, const std::vector<cv::Mat>& outputs, int n);
 	std::vector<proposal> generate_proposals(const cv::Mat& output);
 	std::vector<proposal> nms_filter(const std::vector<proposal>& proposals);
 };
@@ -41,7 +48,7 @@ private:
 class yolo_qual {
 public:
 	yolo_qual() = default;
-	yolo_qual(const std::string& path_model);
+	yolo_qual(const std::vector<unsigned char>& model);
 	float assess(const cv::Mat& image);
 
 private:
@@ -57,9 +64,10 @@ private:
 
 class yolo {
 public: 
-	yolo(const std::string& path_model_detect, const std::string& path_model_assess);
-	yolo(const std::string& path_model_detect);
+	yolo(const std::vector<unsigned char>& model_detect, const std::vector<unsigned char>& model_assess, float confidence_threshold = 0.60, float nms_threshold = 0.5);
+	yolo(const std::vector<unsigned char>& model_detect);
 	std::vector<proposal> find(const cv::Mat& image);
+	std::vector<std::vector<proposal>> find_batch(const std::vector<cv::Mat>& images);
 
 private:
 	bool use_qual = false;
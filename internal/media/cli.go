@@ -0,0 +1,216 @@
+// The ffprobe/ffmpeg backend, both have to be on PATH
+// Does what the libav backend does as near as the command line allows
+// ffmpeg turns rotated video upright by itself, the scale takes care of non-square pixels
+
+package media
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+type CLI struct{}
+
+func newCLI() (Backend, error) {
+	for _, name := range []string{"ffprobe", "ffmpeg"} {
+		_, err := exec.LookPath(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return CLI{}, nil
+}
+
+// Just the parts of ffprobe's JSON that get used
+type probeOutput struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+	} `json:"streams"`
+}
+
+func (CLI) GetMetadata(path string) (map[string]string, error) {
+	res := make(map[string]string)
+
+	probe, err := ffprobe(path)
+	if err != nil {
+		return res, err
+	}
+
+	for k, v := range probe.Format.Tags {
+		res[k] = v
+	}
+
+	res["mediatype"] = "none"
+	for _, s := range probe.Streams {
+		if s.CodecType == "video" && s.CodecName != "ansi" {
+			res["mediatype"] = "video"
+			break
+		}
+
+		if s.CodecType == "audio" {
+			res["mediatype"] = "audio"
+		}
+	}
+
+	// Whole seconds like libav's, an image's 0.04 comes to 0
+	duration, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	ts := int64(duration)
+	if ts > 0 {
+		tm := ts / 60
+		th := tm / 60
+		td := th / 24
+		res["duration"] = fmt.Sprintf("%02d:%02d:%02d:%02d", td, th%24, tm%60, ts%60)
+	} else if res["mediatype"] == "video" {
+		res["mediatype"] = "image"
+	}
+
+	return res, nil
+}
+
+// Both write the WEBP to stdout, nothing touches the disk
+func (CLI) CreateThumbnailX(pathIn string, seek bool, pos float64) ([]byte, error) {
+	args := []string{"-v", "error"}
+	if seek {
+		probe, err := ffprobe(pathIn)
+		if err != nil {
+			return nil, err
+		}
+
+		duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+		if err != nil || duration <= 0 {
+			return nil, ErrSeekFailed
+		}
+
+		args = append(args, "-ss", strconv.FormatFloat(pos*duration, 'f', 3, 64))
+	}
+
+	args = append(args,
+		"-i", pathIn,
+		"-frames:v", "1",
+		"-vf", "scale=w=trunc(540*dar/2)*2:h=540,setsar=1",
+		"-c:v", "libwebp",
+		"-f", "webp",
+		"-")
+
+	b, err := run("ffmpeg", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// A seek past the last frame isn't an error to ffmpeg, it just writes nothing
+	if len(b) == 0 {
+		if seek {
+			return nil, ErrSeekFailed
+		}
+		return nil, errors.New("No frame to take")
+	}
+
+	return b, nil
+}
+
+func (CLI) CreateGenericThumbnail() ([]byte, error) {
+	return run("ffmpeg",
+		"-v", "error",
+		"-f", "lavfi", "-i", "pal75bars=size=960x540",
+		"-frames:v", "1",
+		"-c:v", "libwebp",
+		"-f", "webp",
+		"-")
+}
+
+// Packets are copied out of the video stream as they are, no decoding
+func (CLI) MediaChecksum(path string) (string, error) {
+	hasher, err := blake2b.New512(nil)
+	if err != nil {
+		return "", err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg",
+		"-v", "error",
+		"-i", path,
+		"-an", "-sn", "-dn",
+		"-c", "copy",
+		"-f", "data",
+		"-")
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(hasher, stdout)
+	if err != nil {
+		cmd.Wait()
+		return "", err
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return "", commandError(err, stderr.String())
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func ffprobe(path string) (probeOutput, error) {
+	var probe probeOutput
+
+	out, err := run("ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-i", path)
+	if err != nil {
+		return probe, err
+	}
+
+	err = json.Unmarshal(out, &probe)
+	return probe, err
+}
+
+func run(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, commandError(err, stderr.String())
+	}
+
+	return out, nil
+}
+
+// What ffmpeg said is more use than its exit status
+func commandError(err error, stderr string) error {
+	msg := strings.TrimSpace(stderr)
+	if strings.Contains(msg, "Invalid data found when processing input") {
+		return fmt.Errorf("%w: %s", ErrNotMediaFile, msg)
+	}
+	if msg == "" {
+		return err
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,9 @@
+//go:build !ffmpegcli
+
+package media
+
+// Backend used when none is asked for
+const Default = "libav"
+
+// Default ready to use, for when nothing has picked one yet
+var DefaultBackend Backend = LibAV{}
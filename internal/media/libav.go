@@ -0,0 +1,46 @@
+//go:build !ffmpegcli
+
+// The cgo backend, just avc with its errors translated
+
+package media
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jml-89/http-server-av/internal/avc"
+)
+
+type LibAV struct{}
+
+func init() {
+	backends["libav"] = newLibAV
+}
+
+func newLibAV() (Backend, error) {
+	return LibAV{}, nil
+}
+
+func (LibAV) GetMetadata(path string) (map[string]string, error) {
+	metadata, err := avc.GetMetadata(path)
+	if err != nil && err.Error() == "Invalid data found when processing input" {
+		return metadata, fmt.Errorf("%w: %s", ErrNotMediaFile, err)
+	}
+	return metadata, err
+}
+
+func (LibAV) CreateThumbnailX(pathIn string, seek bool, pos float64) ([]byte, error) {
+	b, err := avc.CreateThumbnailX(pathIn, seek, pos)
+	if errors.Is(err, avc.ErrSeekFailed) {
+		return nil, fmt.Errorf("%w: %s", ErrSeekFailed, err)
+	}
+	return b, err
+}
+
+func (LibAV) CreateGenericThumbnail() ([]byte, error) {
+	return avc.CreateGenericThumbnail()
+}
+
+func (LibAV) MediaChecksum(path string) (string, error) {
+	return avc.MediaChecksum(path)
+}
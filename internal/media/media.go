@@ -0,0 +1,55 @@
+//Media backends
+// What the scanner needs from a media file: its metadata, a thumbnail, a checksum of its video
+// Either straight from libav through cgo (avc), or from the ffprobe and ffmpeg commands
+// The commands cost a process per call, but only need ffmpeg installed where it runs
+// The default is libav, -tags ffmpegcli makes it ffmpeg, -mediabackend picks at run time
+
+package media
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Backend interface {
+	// Container tags, plus mediatype (video, audio, image or none) and duration if there is one
+	GetMetadata(path string) (map[string]string, error)
+
+	// A 540 high WEBP of the frame at pos (0.0 to 1.0), or the first frame without seek
+	CreateThumbnailX(pathIn string, seek bool, pos float64) ([]byte, error)
+
+	// 960x540 test pattern WEBP, for when there's no picture to be had
+	CreateGenericThumbnail() ([]byte, error)
+
+	// Digest of the video stream's packets, so the same video with different metadata matches
+	// Digests from different backends can't be compared
+	MediaChecksum(path string) (string, error)
+}
+
+// Either backend's errors wrap these, so callers can tell what went wrong
+var ErrNotMediaFile = errors.New("File is not an image or video")
+var ErrSeekFailed = errors.New("Seek failed")
+
+// libav adds itself, builds tagged ffmpegcli leave it out
+var backends = map[string]func() (Backend, error){
+	"ffmpeg": newCLI,
+}
+
+func New(name string) (Backend, error) {
+	fn, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown media backend %s, expected one of %s", name, strings.Join(Names(), ", "))
+	}
+	return fn()
+}
+
+func Names() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,83 @@
+package media
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A stand-in ffprobe that prints the given output, or fails like ffprobe does on junk
+func fakeFFprobe(t *testing.T, output string) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat <<'EOF'\n" + output + "\nEOF\n"
+	if output == "" {
+		script = "#!/bin/sh\necho 'x.txt: Invalid data found when processing input' >&2\nexit 1\n"
+	}
+
+	err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// The CLI backend should describe files the same way avc.GetMetadata does
+func TestCLIMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   map[string]string
+	}{
+		{
+			name: "video",
+			output: `{"format": {"duration": "3725.5", "tags": {"title": "Hello"}},
+				"streams": [{"codec_type": "audio", "codec_name": "aac"}, {"codec_type": "video", "codec_name": "h264"}]}`,
+			want: map[string]string{"title": "Hello", "mediatype": "video", "duration": "00:01:02:05"},
+		},
+		{
+			name:   "image",
+			output: `{"format": {"duration": "0.040000"}, "streams": [{"codec_type": "video", "codec_name": "mjpeg"}]}`,
+			want:   map[string]string{"mediatype": "image"},
+		},
+		{
+			name:   "audio",
+			output: `{"format": {"duration": "61"}, "streams": [{"codec_type": "audio", "codec_name": "flac"}]}`,
+			want:   map[string]string{"mediatype": "audio", "duration": "00:00:01:01"},
+		},
+		{
+			name:   "ansi art is not video",
+			output: `{"format": {}, "streams": [{"codec_type": "video", "codec_name": "ansi"}]}`,
+			want:   map[string]string{"mediatype": "none"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeFFprobe(t, test.output)
+
+			got, err := CLI{}.GetMetadata("x")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			for k, v := range test.want {
+				if got[k] != v {
+					t.Errorf("%s: got %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+
+	t.Run("not media", func(t *testing.T) {
+		fakeFFprobe(t, "")
+
+		_, err := CLI{}.GetMetadata("x.txt")
+		if !errors.Is(err, ErrNotMediaFile) {
+			t.Errorf("got %v, want ErrNotMediaFile", err)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package thumbstore
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Files in a directory, which can be anywhere (a separate SSD, outside a read-only media mount)
+// "abcdef.webp" is kept at root/ab/abcdef.webp, "360/abcdef.webp" at root/360/ab/abcdef.webp
+// A flat directory of millions of files is miserable for every filesystem tool going
+//
+// Everything used to be flat in .thumbs, so flat files are still found, they're just not written
+type DirStore struct {
+	root string
+}
+
+func NewDirStore(root string) (*DirStore, error) {
+	err := os.MkdirAll(root, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirStore{root: root}, nil
+}
+
+func (s *DirStore) path(name string) string {
+	dir, base := path.Split(name)
+	shard := base
+	if len(base) > 2 {
+		shard = base[:2]
+	}
+	return filepath.Join(s.root, filepath.FromSlash(dir), shard, base)
+}
+
+func (s *DirStore) flatPath(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *DirStore) Get(name string) ([]byte, error) {
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.ReadFile(s.flatPath(name))
+	}
+	return b, err
+}
+
+// Written under a temporary name then renamed, so readers never see half a file
+func (s *DirStore) Put(name string, b []byte) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+
+	pathOut := s.path(name)
+	dir := filepath.Dir(pathOut)
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "http-server-av.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(b)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), pathOut)
+}
+
+// Removes both the sharded and flat copies, if there are both
+func (s *DirStore) Delete(name string) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, p := range []string{s.path(name), s.flatPath(name)} {
+		err = os.Remove(p)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if !found {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (s *DirStore) Has(name string) (bool, error) {
+	err := checkName(name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range []string{s.path(name), s.flatPath(name)} {
+		_, err = os.Stat(p)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// Sharded files are told apart from flat ones by their directory
+// Shards are two characters and match the start of the name, size directories are longer
+func (s *DirStore) Walk(fn func(Entry) error) error {
+	return filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), "http-server-av.") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		dir, base := path.Split(name)
+		parent := path.Base(dir)
+		if len(parent) == 2 && strings.HasPrefix(base, parent) {
+			name = path.Join(path.Dir(path.Clean(dir)), base)
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fn(Entry{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
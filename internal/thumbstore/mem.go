@@ -0,0 +1,86 @@
+package thumbstore
+
+import (
+	"io/fs"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Everything in a map, gone when the program ends
+// For tests mostly
+type MemStore struct {
+	mu    sync.Mutex
+	blobs map[string]memBlob
+}
+
+type memBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{blobs: make(map[string]memBlob)}
+}
+
+func (s *MemStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, ok := s.blobs[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return slices.Clone(blob.data), nil
+}
+
+func (s *MemStore) Put(name string, b []byte) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[name] = memBlob{data: slices.Clone(b), modTime: time.Now()}
+	return nil
+}
+
+func (s *MemStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobs[name]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *MemStore) Has(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.blobs[name]
+	return ok, nil
+}
+
+// Works on a copy, so fn can take its time
+func (s *MemStore) Walk(fn func(Entry) error) error {
+	s.mu.Lock()
+	entries := make([]Entry, 0, len(s.blobs))
+	for name, blob := range s.blobs {
+		entries = append(entries, Entry{Name: name, Size: int64(len(blob.data)), ModTime: blob.modTime})
+	}
+	s.mu.Unlock()
+
+	for _, entry := range entries {
+		err := fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
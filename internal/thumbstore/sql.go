@@ -0,0 +1,106 @@
+package thumbstore
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// Blobs in a SQLite table
+// Either the main database, or a separate one to keep the main one small
+// One file to copy around, nothing to shard, and no directory listings to speak of
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	_, err := db.Exec(`
+		create table if not exists thumbblob (
+			name text,
+			data blob not null,
+			created integer not null,
+			primary key (name)
+		);`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Get(name string) ([]byte, error) {
+	var b []byte
+	err := s.db.QueryRow(`select data from thumbblob where name = :name;`,
+		sql.Named("name", name)).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	return b, err
+}
+
+func (s *SQLStore) Put(name string, b []byte) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		insert or replace into
+			thumbblob (name, data, created)
+			values (:name, :data, :created);`,
+		sql.Named("name", name),
+		sql.Named("data", b),
+		sql.Named("created", time.Now().Unix()))
+	return err
+}
+
+func (s *SQLStore) Delete(name string) error {
+	res, err := s.db.Exec(`delete from thumbblob where name = :name;`,
+		sql.Named("name", name))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (s *SQLStore) Has(name string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`select count(*) from thumbblob where name = :name;`,
+		sql.Named("name", name)).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLStore) Walk(fn func(Entry) error) error {
+	rows, err := s.db.Query(`select name, length(data), created from thumbblob;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry Entry
+		var created int64
+		err = rows.Scan(&entry.Name, &entry.Size, &created)
+		if err != nil {
+			return err
+		}
+		entry.ModTime = time.Unix(created, 0)
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
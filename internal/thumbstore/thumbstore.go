@@ -0,0 +1,44 @@
+//Thumbnail storage
+// Thumbnails, previews and sprite sheets are all just named blobs
+// Names are digests like "ab12...ef.webp", optionally under a directory like "360/" for size variants
+// Where the blobs actually live is up to the ThumbStore:
+//   DirStore - files in a directory, sharded by the start of the digest
+//   SQLStore - blobs in a SQLite table
+//   MemStore - a map, for tests
+
+package thumbstore
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Missing blobs are reported as fs.ErrNotExist, from every store
+type ThumbStore interface {
+	Get(name string) ([]byte, error)
+	Put(name string, b []byte) error
+	Delete(name string) error
+	Has(name string) (bool, error)
+
+	// Calls fn for every blob, stops at the first error
+	// Don't Put or Delete from inside fn, collect names and do it after
+	Walk(fn func(Entry) error) error
+}
+
+type Entry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+var errBadName = errors.New("Invalid thumbnail name")
+
+// Names come from URLs among other places, so no escaping the store with ".."
+func checkName(name string) error {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, "\\") {
+		return errBadName
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package thumbstore
+
+import (
+	"testing"
+
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Every store should behave the same from the outside
+func TestStores(t *testing.T) {
+	pathDir, err := os.MkdirTemp(os.TempDir(), "http-server-av.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pathDir)
+
+	dirStore, err := NewDirStore(pathDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	sqlStore, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]ThumbStore{
+		"dir": dirStore,
+		"sql": sqlStore,
+		"mem": NewMemStore(),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, store)
+		})
+	}
+}
+
+func testStore(t *testing.T, store ThumbStore) {
+	blobs := map[string]string{
+		"abcdef.webp":     "thumbnail",
+		"360/abcdef.webp": "variant",
+	}
+
+	for name, data := range blobs {
+		err := store.Put(name, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, data := range blobs {
+		b, err := store.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != data {
+			t.Fatalf("%s: expected %s, got %s", name, data, b)
+		}
+	}
+
+	_, err := store.Get("missing.webp")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	err = store.Put("../escape.webp", []byte("nope"))
+	if err == nil {
+		t.Fatal("expected an error for a name outside the store")
+	}
+
+	names := make([]string, 0, len(blobs))
+	err = store.Walk(func(entry Entry) error {
+		names = append(names, entry.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"360/abcdef.webp", "abcdef.webp"}) {
+		t.Fatalf("unexpected walk %v", names)
+	}
+
+	err = store.Delete("abcdef.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := store.Has("abcdef.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("deleted blob still there")
+	}
+
+	err = store.Delete("abcdef.webp")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+// Thumbnails from before sharding are still found where they were
+func TestDirStoreFlat(t *testing.T) {
+	pathDir, err := os.MkdirTemp(os.TempDir(), "http-server-av.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pathDir)
+
+	err = os.WriteFile(filepath.Join(pathDir, "abcdef.webp"), []byte("old"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewDirStore(pathDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := store.Get("abcdef.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "old" {
+		t.Fatalf("expected old, got %s", b)
+	}
+
+	names := make([]string, 0, 1)
+	err = store.Walk(func(entry Entry) error {
+		names = append(names, entry.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"abcdef.webp"}) {
+		t.Fatalf("unexpected walk %v", names)
+	}
+}
@@ -24,6 +24,8 @@ var routeDefaultSearches = map[string]map[string]SearchBundle{
 //
 // method "post" implies a redirect and no template
 // method "get" implies at least a template
+//
+// {{name}} in a redirect is replaced with the request's "name" value
 var routeDefaults = map[string]map[string]string{
 	"/": {
 		"method":   "get",
@@ -77,6 +79,26 @@ var routeDefaults = map[string]map[string]string{
 		"method":   "get",
 		"template": "duplicates",
 	},
+
+	// Faces come from /faces/<id>, names go to /people/name, see ServeFaces and ServePeople
+	"/people/": {
+		"alias":    "People",
+		"method":   "get",
+		"template": "people",
+	},
+
+	// Unpinning is /thumbs/unpin, see ServeUnpin
+	"/thumbs/pin": {
+		"method":   "post",
+		"redirect": "/watch?filename={{filename}}",
+	},
+
+	// Changes go to /scoring/set, see ServeScoring
+	"/scoring/": {
+		"alias":    "Scoring",
+		"method":   "get",
+		"template": "scoring",
+	},
 }
 
 var routeDefaultValues = map[string]map[string]string{
@@ -93,6 +115,70 @@ var routeDefaultValues = map[string]map[string]string{
 // :variable are sourced from request parameters
 var routeDefaultQueries = map[string]map[string]string{
 	"/watch": {
+		"poster": `
+			select bestthumb
+			from mediastat
+			where filename = :filename;
+		`,
+
+		"pinned": `
+			select pinned
+			from mediastat
+			where filename = :filename;
+		`,
+
+		"people": `
+			select distinct c.name, c.id
+			from thumbmap a
+			inner join thumbface b
+			on a.thumbname = b.thumbname
+			inner join person c
+			on b.personid = c.id
+			where a.filename = :filename
+			and c.name != ''
+			order by c.name;
+		`,
+
+		// Percentages of the thumbnail, for drawing over it
+		"faceboxes": `
+			select
+				b.thumbname,
+				printf('%.2f', b.box_x * 100),
+				printf('%.2f', b.box_y * 100),
+				printf('%.2f', b.box_w * 100),
+				printf('%.2f', b.box_h * 100),
+				printf('%.2f', b.confidence),
+				printf('%.2f', b.quality)
+			from thumbmap a
+			inner join thumbface b
+			on a.thumbname = b.thumbname
+			where a.filename = :filename
+			and b.box_x is not null;
+		`,
+
+		"facepoints": `
+			select
+				b.thumbname,
+				printf('%.2f', json_extract(c.value, '$[0]') * 100),
+				printf('%.2f', json_extract(c.value, '$[1]') * 100)
+			from thumbmap a
+			inner join thumbface b
+			on a.thumbname = b.thumbname
+			inner join json_each(b.landmarks) c
+			where a.filename = :filename
+			and b.landmarks is not null;
+		`,
+
+		"autotags": `
+			select b.label, printf('%.2f', max(b.confidence)) as confidence
+			from thumbmap a
+			inner join thumbtag b
+			on a.thumbname = b.thumbname
+			where a.filename = :filename
+			group by b.label
+			order by confidence desc;
+		`,
+
 		"thumbs": `
 			select 
 				thumbname, 
@@ -195,9 +281,11 @@ var routeDefaultQueries = map[string]map[string]string{
 
 	"/": {
 		"videos": `
-			select filename, bestthumb
-			from mediastat
-			order by rowid desc 
+			select a.filename, a.bestthumb, coalesce(b.previewname, '')
+			from mediastat a
+			left join preview b
+			on a.filename = b.filename
+			order by a.rowid desc 
 			limit 50;
 		`,
 	},
@@ -209,10 +297,12 @@ var routeDefaultQueries = map[string]map[string]string{
 				from ({{searchresults}})
 				where name is :sortcriteria
 			)
-			select b.filename, b.bestthumb
+			select b.filename, b.bestthumb, coalesce(c.previewname, '')
 			from unsorted a
 			join mediastat b
 			on a.filename = b.filename
+			left join preview c
+			on b.filename = c.filename
 			order by 
 				case when :sortorder is 'desc' then a.criteria end desc, 
 				case when :sortorder is 'asc' then a.criteria end asc, 
@@ -253,6 +343,22 @@ var routeDefaultQueries = map[string]map[string]string{
 		`,
 	},
 
+	// Only thumbnails which belong to the file can be pinned
+	"/thumbs/pin": {
+		"query": `
+			update mediastat set
+				bestthumb = a.thumbname,
+				bestscore = b.score,
+				pinned = 1
+			from thumbmap a
+			inner join thumbnail b
+			on a.thumbname = b.thumbname
+			where a.filename = :filename
+			and a.thumbname = :thumbname
+			and mediastat.filename = :filename;
+		`,
+	},
+
 	"/favourites/add": {
 		"query": `
 			insert or replace into
@@ -269,6 +375,40 @@ var routeDefaultQueries = map[string]map[string]string{
 		`,
 	},
 
+	"/scoring/": {
+		"exprs": `
+			select name, expr
+			from scoring
+			order by name desc;
+		`,
+	},
+
+	// Named people first, then everyone else by how often they turn up
+	// The face shown is their clearest one
+	"/people/": {
+		"people": `
+			select
+				c.id,
+				c.name,
+				count(distinct a.filename) as files,
+				(
+					select rowid
+					from thumbface
+					where personid = c.id
+					order by quality * confidence desc
+					limit 1
+				)
+			from person c
+			inner join thumbface b
+			on b.personid = c.id
+			inner join thumbmap a
+			on a.thumbname = b.thumbname
+			group by c.id
+			order by c.name = '', files desc, c.name
+			limit 300;
+		`,
+	},
+
 	"/duplicates/": {
 		"dupes": `
 			select bestthumb, count(*)
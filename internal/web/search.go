@@ -36,7 +36,7 @@ func (params *SearchParameters) Prepare() (string, []interface{}) {
 	}
 
 	searchCount := 0
-	prevSearch := "tags"
+	prevSearch := "searchtags"
 
 	for _, v := range params.Vals {
 		bricks = append(bricks, glue)
@@ -46,7 +46,7 @@ func (params *SearchParameters) Prepare() (string, []interface{}) {
 		bricks = append(bricks,
 			fmt.Sprintf(`%s(filename, name, val, rowid) as (
 				select filename, name, val, rowid
-				from tags
+				from searchtags
 				where filename in (
 					select distinct(filename) 
 					from %s
@@ -65,7 +65,7 @@ func (params *SearchParameters) Prepare() (string, []interface{}) {
 		bricks = append(bricks,
 			fmt.Sprintf(`%s(filename, name, val, rowid) as (
 				select filename, name, val, rowid
-				from tags
+				from searchtags
 				where filename in (
 					select distinct(filename) 
 					from %s
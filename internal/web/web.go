@@ -3,8 +3,10 @@
 package web
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"html/template"
@@ -13,8 +15,11 @@ import (
 	"net/url"
 	"strings"
 	"io"
-	"path/filepath"
-	"os"
+	"io/fs"
+	"strconv"
+	"time"
+	"github.com/jml-89/http-server-av/internal/av"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
 	"github.com/jml-89/http-server-av/internal/util"
 )
 
@@ -34,10 +39,57 @@ type SearchBundle struct {
 }
 
 // Thumbnails act like a simple fileserver
-// But they're served out of the database (stored as blobs)
-func ServeThumbs(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+// But they're served out of a ThumbStore (directory, database blobs, ...)
+// ?size= and ?crop= only pick out variants made in the background, nothing is made on request
+func ServeThumbs(store thumbstore.ThumbStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		thumbServer(db, w, r)
+		thumbServer(store, w, r)
+	}
+}
+
+// WebVTT track of sprite sheet tiles, for scrubbing previews on the watch page
+// Cue text is the sheet URL with a media fragment picking out the tile
+func ServeSprites(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		spriteServer(db, w, r)
+	}
+}
+
+// Scoring expressions have to be checked before they're saved, which a route query can't do
+// Errors are passed back to /scoring/ as the "error" parameter
+func ServeScoring(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scoringServer(db, w, r)
+	}
+}
+
+// Takes a thumbnail at the "time" (seconds) the player was at and pins it
+// Back to the watch page afterwards, errors are logged and otherwise ignored
+func ServeCapture(db *sql.DB, store thumbstore.ThumbStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		captureServer(db, store, w, r)
+	}
+}
+
+// Unpinning has to reselect the best thumbnail after clearing the pin, more than a route query does
+func ServeUnpin(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unpinServer(db, w, r)
+	}
+}
+
+// Square crops of faces for the people page, /faces/<id>?size=160
+// id is the face's thumbface rowid
+func ServeFaces(db *sql.DB, store thumbstore.ThumbStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		faceServer(db, store, w, r)
+	}
+}
+
+// Naming a person needs their tags redone and maybe a merge, more than a route query does
+func ServePeople(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peopleServer(db, w, r)
 	}
 }
 
@@ -59,23 +111,202 @@ func AddRoutes(db *sql.DB) error {
 	return nil
 }
 
-func thumbServer(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+// ?size=360 and the like serve a resized copy, see av.ThumbSizes
+func thumbServer(store thumbstore.ThumbStore, w http.ResponseWriter, r *http.Request) {
 	thumbname := r.URL.Path[5:]
-	thumbpath := filepath.Join(".thumbs", thumbname)
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	crop := r.URL.Query().Get("crop")
 
-	fi, err := os.Open(thumbpath)
+	b, err := av.CachedVariant(store, thumbname, size, crop)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		fmt.Fprintf(w, err.Error())
 		return
 	}
 
-	_, err = io.Copy(w, fi)
+	http.ServeContent(w, r, thumbname, time.Time{}, bytes.NewReader(b))
+}
+
+func scoringServer(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		fmt.Fprintf(w, "Expected POST, got %s", r.Method)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	redirect := "/scoring/"
+	for _, name := range []string{"score", "threshold"} {
+		if _, ok := r.PostForm[name]; !ok {
+			continue
+		}
+
+		err = av.SetScoring(db, name, r.PostForm.Get(name))
+		if err != nil {
+			log.Println(err)
+			redirect = "/scoring/?error=" + url.QueryEscape(err.Error())
+			break
+		}
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func captureServer(db *sql.DB, store thumbstore.ThumbStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		fmt.Fprintf(w, "Expected POST, got %s", r.Method)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	filename := r.PostForm.Get("filename")
+	seconds, err := strconv.ParseFloat(r.PostForm.Get("time"), 64)
+	if err != nil {
+		log.Println(err)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	_, err = av.CaptureThumbnail(db, store, filename, seconds)
+	if err != nil {
+		log.Println(err)
+	}
+
+	http.Redirect(w, r, "/watch?filename="+url.QueryEscape(filename), http.StatusFound)
+}
+
+func unpinServer(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		fmt.Fprintf(w, "Expected POST, got %s", r.Method)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	filename := r.PostForm.Get("filename")
+	err = av.Unpin(db, filename)
+	if err != nil {
+		log.Println(err)
+	}
+
+	http.Redirect(w, r, "/watch?filename="+url.QueryEscape(filename), http.StatusFound)
+}
+
+func faceServer(db *sql.DB, store thumbstore.ThumbStore, w http.ResponseWriter, r *http.Request) {
+	faceid, err := strconv.ParseInt(r.URL.Path[len("/faces/"):], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 || size > 1080 {
+		size = 160
+	}
+
+	b, err := av.FaceCrop(db, store, faceid, size)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		fmt.Fprintf(w, err.Error())
 		return
 	}
+
+	http.ServeContent(w, r, fmt.Sprintf("%d.webp", faceid), time.Time{}, bytes.NewReader(b))
+}
+
+func peopleServer(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		fmt.Fprintf(w, "Expected POST, got %s", r.Method)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PostForm.Get("id"), 10, 64)
+	if err != nil {
+		log.Println(err)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	err = av.NamePerson(db, id, strings.TrimSpace(r.PostForm.Get("name")))
+	if err != nil {
+		log.Println(err)
+	}
+
+	http.Redirect(w, r, "/people/", http.StatusFound)
+}
+
+func spriteServer(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+
+	var sheetname string
+	var interval float64
+	var count, columns, tilew, tileh int
+	err := db.QueryRow(`
+		select sheetname, interval, count, columns, tilew, tileh
+		from spritesheet
+		where filename = :filename
+		and sheetname != '';`,
+		sql.Named("filename", filename),
+	).Scan(&sheetname, &interval, &count, &columns, &tilew, &tileh)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	vttTime := func(t float64) string {
+		ms := int64(t * 1000)
+		return fmt.Sprintf("%02d:%02d:%02d.%03d",
+			ms/3600000, (ms/60000)%60, (ms/1000)%60, ms%1000)
+	}
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&b, "\n%s --> %s\n/tmb/%s#xywh=%d,%d,%d,%d\n",
+			vttTime(float64(i)*interval), vttTime(float64(i+1)*interval),
+			url.PathEscape(sheetname),
+			(i%columns)*tilew, (i/columns)*tileh, tilew, tileh)
+	}
+
+	w.Header().Set("Content-Type", "text/vtt")
+	_, err = io.WriteString(w, b.String())
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 func loadTemplate(db *sql.DB, name string) (*template.Template, error) {
@@ -110,6 +341,29 @@ func loadTemplate(db *sql.DB, name string) (*template.Template, error) {
 		s = strings.Join(parts[:len(parts)-1], ".")
 		return s
 	}
+	// srcset of the thumbnail size variants
+	// Widths assume 16:9, close enough for the browser to pick a sensible one
+	fns["thumbsrcset"] = func(thumbname string) template.Srcset {
+		variants := make([]string, 0, len(av.ThumbSizes))
+		for _, size := range av.ThumbSizes {
+			variants = append(variants, fmt.Sprintf("/tmb/%s?size=%d %dw",
+				url.PathEscape(thumbname), size, size*16/9))
+		}
+		return template.Srcset(strings.Join(variants, ", "))
+	}
+	// Same again cropped to one of av.ThumbCrops, {{index $elem 1 | thumbsrcsetcrop "4:5"}}
+	fns["thumbsrcsetcrop"] = func(crop, thumbname string) template.Srcset {
+		aspect, ok := av.ThumbCrops[crop]
+		if !ok {
+			aspect = 16.0 / 9
+		}
+		variants := make([]string, 0, len(av.ThumbSizes))
+		for _, size := range av.ThumbSizes {
+			variants = append(variants, fmt.Sprintf("/tmb/%s?size=%d&crop=%s %dw",
+				url.PathEscape(thumbname), size, url.QueryEscape(crop), int(float64(size)*aspect)))
+		}
+		return template.Srcset(strings.Join(variants, ", "))
+	}
 	tmpl := template.Must(template.New("base").Parse(string(rawBase)))
 	template.Must(tmpl.New("body").Funcs(fns).Parse(string(rawTmpl)))
 
@@ -354,6 +608,9 @@ func superSoftServe(db *sql.DB, key string, w http.ResponseWriter, req *http.Req
 	}
 
 	if redirect != "" {
+		for k, vs := range req.Form {
+			redirect = strings.ReplaceAll(redirect, fmt.Sprintf("{{%s}}", k), url.QueryEscape(vs[0]))
+		}
 		http.Redirect(w, req, redirect, http.StatusFound)
 		return
 	}
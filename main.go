@@ -11,9 +11,15 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/jml-89/http-server-av/internal/av"
+	"github.com/jml-89/http-server-av/internal/avc"
+	"github.com/jml-89/http-server-av/internal/media"
+	"github.com/jml-89/http-server-av/internal/thumbstore"
 	"github.com/jml-89/http-server-av/internal/util"
 	"github.com/jml-89/http-server-av/internal/web"
 )
@@ -22,6 +28,22 @@ var flagPort = flag.Int("port", 8080, "webserver port")
 var flagPath = flag.String("path", ".", "directory to serve")
 var flagPathDB = flag.String("db", ".info.db", "media info database path")
 var flagConc = flag.Int("conc", 2, "number of concurrent file scanner / thumbnailers to run")
+var flagThumbStore = flag.String("thumbstore", "dir", "where thumbnails are kept: dir or sqlite")
+var flagThumbPath = flag.String("thumbpath", "", "thumbnail directory for dir (default .thumbs), database file for sqlite (default the -db database)")
+var flagThumbGC = flag.String("thumbgc", "report", "unreferenced thumbnail files: off, report, delete or quarantine")
+
+// Changing any of these gets thumbnails evaluated again in the background
+var flagFaceModel = flag.String("facemodel", "", "face detection ONNX model (default built in yolov8n-face)")
+var flagQualityModel = flag.String("qualitymodel", "", "face quality ONNX model (default built in)")
+var flagEmbedModel = flag.String("embedmodel", "", "face embedding ONNX model, faces are only grouped into people with one")
+var flagTagModel = flag.String("tagmodel", "", "auto-tagging classifier ONNX model, thumbnails are only autotagged with one")
+var flagTagLabels = flag.String("taglabels", "", "labels for -tagmodel, one per line")
+var flagFaceConfidence = flag.Float64("faceconfidence", 0.6, "minimum face detection confidence")
+var flagFaceNMS = flag.Float64("facenms", 0.5, "overlap past which face detections are merged")
+var flagTagConfidence = flag.Float64("tagconfidence", 0.5, "minimum auto-tag confidence")
+var flagFaceBatch = flag.Int("facebatch", 8, "thumbnails per face detection pass")
+var flagMediaBackend = flag.String("mediabackend", media.Default, "how media files are read: libav (built in, not in ffmpegcli builds) or ffmpeg (runs ffprobe and ffmpeg)")
+var flagImprover = flag.String("improver", "probe", "how better thumbnails are looked for: probe (one frame per file at a time) or sweep (thirty frames per file in one pass)")
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -29,6 +51,20 @@ func main() {
 
 	flag.Parse()
 
+	if !slices.Contains(av.GCModes, av.GCMode(*flagThumbGC)) {
+		log.Fatalf("Unknown -thumbgc mode %s, expected one of %v\n", *flagThumbGC, av.GCModes)
+	}
+
+	backend, err := media.New(*flagMediaBackend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	av.Backend = backend
+
+	if *flagImprover != "probe" && *flagImprover != "sweep" {
+		log.Fatalf("Unknown -improver %s, expected probe or sweep\n", *flagImprover)
+	}
+
 	if *flagPath != "." {
 		err := os.Chdir(*flagPath)
 		if err != nil {
@@ -99,7 +135,18 @@ func main() {
 	}
 
 	http.Handle("/file/", http.StripPrefix("/file/", http.FileServer(http.Dir(pathMedia))))
-	http.HandleFunc("/tmb/", web.ServeThumbs(db))
+	store, pathStore, err := openThumbStore(db)
+	if err != nil {
+		log.Fatalf("Failed to open thumbnail store: %s\n", err)
+	}
+
+	http.HandleFunc("/tmb/", web.ServeThumbs(store))
+	http.HandleFunc("/sprites/", web.ServeSprites(db))
+	http.HandleFunc("/scoring/set", web.ServeScoring(db))
+	http.HandleFunc("/thumbs/capture", web.ServeCapture(db, store))
+	http.HandleFunc("/thumbs/unpin", web.ServeUnpin(db))
+	http.HandleFunc("/faces/", web.ServeFaces(db, store))
+	http.HandleFunc("/people/name", web.ServePeople(db))
 	err = web.AddRoutes(db)
 	if err != nil {
 		log.Fatal(err)
@@ -111,19 +158,38 @@ func main() {
 	fmt.Printf("*\n*\tWebserver running on port %d\n*\n", *flagPort)
 
 	go func() {
-		ignores := []string{".thumbs", pathDb}
-		_, err := av.AddFilesToDB(db, ignores, *flagConc, pathMedia)
+		ignores := []string{".thumbs"}
+		for _, path := range []string{pathDb, pathStore} {
+			rel, ok := inside(pathMedia, path)
+			if ok {
+				ignores = append(ignores, rel)
+			}
+		}
+
+		_, err := av.AddFilesToDB(db, store, ignores, *flagConc, pathMedia)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 		log.Println("Initial media scan complete")
+
+		gcMode := av.GCMode(*flagThumbGC)
+		if gcMode != av.GCOff {
+			res, err := av.ThumbGC(db, store, gcMode)
+			if err != nil {
+				log.Println(err)
+			} else {
+				log.Printf("Thumbnail GC (%s): %s", gcMode, res)
+			}
+		}
+
 		log.Println("Starting thumbnail improver")
 
-		go thumbImprover(db, *flagConc)
+		go thumbImprover(db, store, *flagConc)
+		go extrasMaker(db, store)
 
 		for {
-			n, err := av.AddFilesToDB(db, ignores, *flagConc, pathMedia)
+			n, err := av.AddFilesToDB(db, store, ignores, *flagConc, pathMedia)
 			if err != nil {
 				log.Println(err)
 				return
@@ -165,8 +231,20 @@ func main() {
 	return
 }
 
-func thumbImprover(db *sql.DB, numThreads int) {
-	ev, err := av.NewEvaluator(numThreads)
+func thumbImprover(db *sql.DB, store thumbstore.ThumbStore, numThreads int) {
+	cfg := avc.DefaultThumbnailerConfig()
+	cfg.Threads = numThreads
+	cfg.FaceBatch = *flagFaceBatch
+	cfg.DetectModel = *flagFaceModel
+	cfg.AssessModel = *flagQualityModel
+	cfg.EmbedModel = *flagEmbedModel
+	cfg.TagModel = *flagTagModel
+	cfg.TagLabels = *flagTagLabels
+	cfg.FaceConfidence = float32(*flagFaceConfidence)
+	cfg.FaceNMS = float32(*flagFaceNMS)
+	cfg.TagConfidence = float32(*flagTagConfidence)
+
+	ev, err := av.NewEvaluator(cfg, store)
 	if err != nil {
 		log.Println(err)
 		return
@@ -184,7 +262,18 @@ func thumbImprover(db *sql.DB, numThreads int) {
 			}
 		}
 
-		numImproved, err := av.Improver(db)
+		// Without OpenCV every frame scores the same, probing for better ones is wasted effort
+		if !avc.OpenCV {
+			time.Sleep(time.Duration(rand.Intn(60)) * time.Second)
+			continue
+		}
+
+		var numImproved int
+		if *flagImprover == "sweep" {
+			numImproved, err = ev.Sweep(db)
+		} else {
+			numImproved, err = av.Improver(db, store)
+		}
 		if err != nil {
 			log.Println(err)
 			if err.Error() == "database is locked" {
@@ -211,3 +300,93 @@ func thumbImprover(db *sql.DB, numThreads int) {
 		}
 	}
 }
+
+// Hover previews, scrubbing sprites and thumbnail sizes are nice-to-haves, so they get made at a leisurely pace
+func extrasMaker(db *sql.DB, store thumbstore.ThumbStore) {
+	makers := []func(*sql.DB, thumbstore.ThumbStore, int) (int, error){
+		av.MakePreviews,
+		av.MakeSpriteSheets,
+		av.MakeVariants,
+	}
+
+	for {
+		total := 0
+		for _, maker := range makers {
+			n, err := maker(db, store, 10)
+			if err != nil {
+				log.Println(err)
+				if err.Error() == "database is locked" {
+					err = nil
+					time.Sleep(time.Duration(rand.Intn(30)) * time.Second)
+				} else {
+					return
+				}
+			}
+			total += n
+		}
+
+		if total == 0 {
+			time.Sleep(time.Duration(rand.Intn(60)) * time.Second)
+		}
+	}
+}
+
+// Where path is relative to dir, if it's in there at all
+func inside(dir, path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// Relative paths are relative to the media directory, same as -db
+// Also returns the path used, if it's one the media scan should skip
+func openThumbStore(db *sql.DB) (thumbstore.ThumbStore, string, error) {
+	switch *flagThumbStore {
+	case "dir":
+		pathStore := *flagThumbPath
+		if pathStore == "" {
+			pathStore = ".thumbs"
+		}
+
+		store, err := thumbstore.NewDirStore(pathStore)
+		return store, pathStore, err
+
+	case "sqlite":
+		if *flagThumbPath == "" || *flagThumbPath == *flagPathDB {
+			store, err := thumbstore.NewSQLStore(db)
+			return store, "", err
+		}
+
+		dbThumbs, err := sql.Open("sqlite3", *flagThumbPath)
+		if err != nil {
+			return nil, "", err
+		}
+
+		_, err = dbThumbs.Exec("pragma journal_mode = wal;")
+		if err != nil {
+			return nil, "", err
+		}
+
+		store, err := thumbstore.NewSQLStore(dbThumbs)
+		return store, *flagThumbPath, err
+	}
+
+	return nil, "", fmt.Errorf("Unknown -thumbstore %s, expected dir or sqlite", *flagThumbStore)
+}